@@ -0,0 +1,32 @@
+// PasswdHash generates bcrypt hash of client password (auth client passwordHash)
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func main() {
+	// config
+	var costFlag = flag.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	flag.Parse()
+
+	// password read from stdin (not from args, so not kept in shell history)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("fail: read password: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), *costFlag)
+	if err != nil {
+		log.Fatalf("fail: generate hash: %v", err)
+	}
+	fmt.Println(string(hash))
+}
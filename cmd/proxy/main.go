@@ -3,9 +3,11 @@ package main
 import (
 	"log"
 
+	"github.com/radisvaliullin/proxy/pkg/admin"
 	"github.com/radisvaliullin/proxy/pkg/auth"
 	"github.com/radisvaliullin/proxy/pkg/balancer"
 	"github.com/radisvaliullin/proxy/pkg/config"
+	"github.com/radisvaliullin/proxy/pkg/discovery"
 	"github.com/radisvaliullin/proxy/pkg/proxy"
 )
 
@@ -19,14 +21,44 @@ func main() {
 	log.Printf("main: config: %+v", config)
 
 	// init dependencies
-	au := auth.New(config.Auth)
+	au, err := auth.New(config.Auth)
+	if err != nil {
+		log.Fatalf("main: auth init: %v", err)
+	}
 	// balancer
-	blnConf := balancer.Config{UpstrmAddrs: config.Proxy.UpstreamAddrs}
+	blnConf := config.Balancer
+	blnConf.UpstrmAddrs = config.Proxy.UpstreamAddrs
 	blncer, err := balancer.New(blnConf, au)
 	if err != nil {
 		log.Fatalf("main: balancer init: %v", err)
 	}
 
+	// file upstream discovery (optional)
+	if config.Discovery.File != "" {
+		disc, err := discovery.NewFile(config.Discovery, blncer)
+		if err != nil {
+			log.Fatalf("main: discovery init: %v", err)
+		}
+		go func() {
+			if err := disc.Start(); err != nil {
+				log.Fatalf("main: discovery start: %v", err)
+			}
+		}()
+	}
+
+	// admin api (optional)
+	if config.Admin.Addr != "" {
+		adm, err := admin.New(config.Admin, blncer)
+		if err != nil {
+			log.Fatalf("main: admin init: %v", err)
+		}
+		go func() {
+			if err := adm.Start(); err != nil {
+				log.Fatalf("main: admin start: %v", err)
+			}
+		}()
+	}
+
 	// init proxy and start
 	p, err := proxy.New(config.Proxy, au, blncer)
 	if err != nil {
@@ -2,4 +2,8 @@ module github.com/radisvaliullin/proxy
 
 go 1.21.1
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sync v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
+)
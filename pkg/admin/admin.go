@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+type Config struct {
+	// Admin api addr (ip/port), empty value disables admin api
+	Addr string `yaml:"addr"`
+}
+
+// Admin provides http api to inspect and manage proxy state
+// GET /upstreams - upstreams state (conns, slow start, circuit breaker)
+// POST /upstreams/drain?addr=<addr>[&timeout=<seconds>] - drain upstream, return remaining sessions
+// POST /upstreams/undrain?addr=<addr> - return drained upstream to balancing
+// GET /metrics - metrics published via expvar
+type Admin struct {
+	config Config
+
+	blncer balancer.IAdmin
+}
+
+func New(conf Config, blncer balancer.IAdmin) (*Admin, error) {
+	a := &Admin{
+		config: conf,
+		blncer: blncer,
+	}
+	return a, nil
+}
+
+func (a *Admin) Start() error {
+	log.Print("admin: start.")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", a.handleUpstreams)
+	mux.HandleFunc("/upstreams/drain", a.handleDrain)
+	mux.HandleFunc("/upstreams/undrain", a.handleUndrain)
+	mux.Handle("/metrics", expvar.Handler())
+
+	if err := http.ListenAndServe(a.config.Addr, mux); err != nil {
+		log.Printf("admin: start: listen and serve: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (a *Admin) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.blncer.UpstreamsState())
+}
+
+// drain response
+type drainResp struct {
+	Addr  string `json:"addr"`
+	Conns int    `json:"conns"`
+}
+
+func (a *Admin) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	var timeout time.Duration
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		sec, err := strconv.Atoi(t)
+		if err != nil || sec < 0 {
+			http.Error(w, "wrong timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(sec) * time.Second
+	}
+	conns, err := a.blncer.Drain(addr, timeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, drainResp{Addr: addr, Conns: conns})
+}
+
+func (a *Admin) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.blncer.Undrain(r.URL.Query().Get("addr")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin: write json: %v", err)
+	}
+}
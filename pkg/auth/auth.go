@@ -1,5 +1,13 @@
 package auth
 
+import (
+	"log"
+	"net/netip"
+	"sort"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
 var _ IAuth = (*Auth)(nil)
 
 type Config struct {
@@ -10,13 +18,60 @@ type Config struct {
 // Auth provides authorization (list available upstreams, limit of connections, etc)
 type Auth struct {
 	conf Config
+
+	// client source nets, most specific first
+	sourceNets []sourceNet
+	// compared for unknown clients, so unknown and known client checks take same time
+	dummyHash []byte
 }
 
-func New(config Config) *Auth {
+// client id of source net
+type sourceNet struct {
+	prefix   netip.Prefix
+	clientId string
+}
+
+func New(config Config) (*Auth, error) {
 	a := &Auth{
 		conf: config,
 	}
-	return a
+	seen := make(map[netip.Prefix]struct{})
+	for _, c := range config.Clients {
+		if c.Perms.IdleTimeout < 0 || c.Perms.MaxSessionDuration < 0 {
+			log.Printf("auth: config: client %q wrong idle timeout %v or max session duration %v",
+				c.Id, c.Perms.IdleTimeout, c.Perms.MaxSessionDuration)
+			return nil, ErrConfigWrongTimeouts
+		}
+		if c.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+				log.Printf("auth: config: client %q wrong password hash: %v", c.Id, err)
+				return nil, ErrConfigWrongPasswordHash
+			}
+		}
+		for _, cidr := range c.SourceCIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				log.Printf("auth: config: client %q wrong source cidr %q: %v", c.Id, cidr, err)
+				return nil, ErrConfigWrongSourceCIDR
+			}
+			prefix = prefix.Masked()
+			if _, ok := seen[prefix]; ok {
+				log.Printf("auth: config: client %q source cidr %q duplicated", c.Id, cidr)
+				return nil, ErrConfigDuplicatedSourceCIDR
+			}
+			seen[prefix] = struct{}{}
+			a.sourceNets = append(a.sourceNets, sourceNet{prefix: prefix, clientId: c.Id})
+		}
+	}
+	sort.SliceStable(a.sourceNets, func(i, j int) bool {
+		return a.sourceNets[i].prefix.Bits() > a.sourceNets[j].prefix.Bits()
+	})
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	a.dummyHash = dummyHash
+	return a, nil
 }
 
 // AuthN authenticate client
@@ -30,7 +85,43 @@ func (a *Auth) AuthN(clientId string) bool {
 	return false
 }
 
+// AuthNPassword authenticate client by password (client without password not authenticated)
+// password checked against bcrypt hash (constant-time compare)
+func (a *Auth) AuthNPassword(clientId string, password string) bool {
+	hash := a.dummyHash
+	found := false
+	for _, c := range a.conf.Clients {
+		if c.Id == clientId && c.PasswordHash != "" {
+			hash, found = []byte(c.PasswordHash), true
+			break
+		}
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return found && err == nil
+}
+
 // List all clients permissions
 func (a *Auth) AllClientsPerms() Clients {
 	return a.conf.Clients
 }
+
+// ClientPerms return client permissions
+func (a *Auth) ClientPerms(clientId string) (Perms, bool) {
+	for _, c := range a.conf.Clients {
+		if c.Id == clientId {
+			return c.Perms, true
+		}
+	}
+	return Perms{}, false
+}
+
+// ResolveAddr return client id of source addr (longest source cidr match)
+func (a *Auth) ResolveAddr(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, n := range a.sourceNets {
+		if n.prefix.Contains(addr) {
+			return n.clientId, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewClientTimeouts(t *testing.T) {
+	tests := []struct {
+		perms Perms
+		err   error
+	}{
+		{perms: Perms{}},
+		{perms: Perms{IdleTimeout: 30, MaxSessionDuration: 3600}},
+		{perms: Perms{IdleTimeout: -1}, err: ErrConfigWrongTimeouts},
+		{perms: Perms{MaxSessionDuration: -1}, err: ErrConfigWrongTimeouts},
+	}
+	for _, tt := range tests {
+		_, err := New(Config{Clients: Clients{{Id: "c", Perms: tt.perms}}})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("perms %+v: error %v, want %v", tt.perms, err, tt.err)
+		}
+	}
+}
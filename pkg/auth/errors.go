@@ -0,0 +1,42 @@
+package auth
+
+import "fmt"
+
+const (
+	ErrKindConfigWrongTimeouts = iota
+	ErrKindConfigWrongSourceCIDR
+	ErrKindConfigDuplicatedSourceCIDR
+	ErrKindConfigWrongPasswordHash
+)
+
+var (
+	ErrConfigWrongTimeouts        = AuthError{Kind: ErrKindConfigWrongTimeouts}
+	ErrConfigWrongSourceCIDR      = AuthError{Kind: ErrKindConfigWrongSourceCIDR}
+	ErrConfigDuplicatedSourceCIDR = AuthError{Kind: ErrKindConfigDuplicatedSourceCIDR}
+	ErrConfigWrongPasswordHash    = AuthError{Kind: ErrKindConfigWrongPasswordHash}
+)
+
+func getErrorMessage(kind int) string {
+	switch kind {
+	case ErrKindConfigWrongTimeouts:
+		return "config wrong client idle timeout or max session duration"
+	case ErrKindConfigWrongSourceCIDR:
+		return "config wrong client source cidr"
+	case ErrKindConfigDuplicatedSourceCIDR:
+		return "config client source cidr duplicated"
+	case ErrKindConfigWrongPasswordHash:
+		return "config wrong client password hash"
+	default:
+		return "unknown"
+	}
+}
+
+var _ error = AuthError{}
+
+type AuthError struct {
+	Kind int
+}
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("auth error: %s", getErrorMessage(e.Kind))
+}
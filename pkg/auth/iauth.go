@@ -1,6 +1,11 @@
 package auth
 
+import "net/netip"
+
 type IAuth interface {
 	AuthN(string) bool
 	AllClientsPerms() Clients
+	ClientPerms(string) (Perms, bool)
+	ResolveAddr(netip.Addr) (string, bool)
+	AuthNPassword(clientId string, password string) bool
 }
@@ -3,11 +3,26 @@ package auth
 type Client struct {
 	Id    string `yaml:"id"`
 	Perms Perms  `yaml:"perms"`
+	// source CIDRs identify client on plain listeners (no client certificate)
+	// most specific CIDR wins, CIDR can belong to one client only
+	SourceCIDRs []string `yaml:"sourceCIDRs"`
+	// bcrypt hash of client password, username is client id
+	// used by front ends without client certificate (socks5 username/password)
+	PasswordHash string `yaml:"passwordHash"`
 }
 
+// Perms client permissions
+// UpstreamAddrs and Pools together define list of client upstreams
+// (both empty means all upstreams)
 type Perms struct {
 	UpstreamAddrs []string `yaml:"upstreamAddrs"`
-	Limit         int      `yaml:"limit"`
+	// names of balancer upstream pools
+	Pools []string `yaml:"pools"`
+	Limit int      `yaml:"limit"`
+
+	// in seconds, override proxy timeouts for client (0 - use proxy config value)
+	IdleTimeout        int `yaml:"idleTimeout"`
+	MaxSessionDuration int `yaml:"maxSessionDuration"`
 }
 
 type Clients []Client
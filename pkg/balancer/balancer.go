@@ -1,7 +1,9 @@
 package balancer
 
 import (
+	"log"
 	"sync"
+	"time"
 
 	"github.com/radisvaliullin/proxy/pkg/auth"
 )
@@ -9,30 +11,134 @@ import (
 var _ IBalancer = (*Balancer)(nil)
 
 type Config struct {
-	UpstrmAddrs []string
+	// set from proxy config upstream addrs
+	UpstrmAddrs []string `yaml:"-"`
+	// Named upstream pools
+	// clients reference pools by name in auth perms
+	Pools []Pool `yaml:"pools"`
+
+	// Slow start of new or recovered upstreams (optional)
+	SlowStart SlowStart `yaml:"slowStart"`
+
+	// Circuit breaker per upstream (optional)
+	CircuitBreaker CircuitBreaker `yaml:"circuitBreaker"`
+
+	// Upstream addrs in drain mode on start (for maintenance)
+	// drained upstream is not selected for new connections
+	Drain []string `yaml:"drain"`
+}
+
+// SlowStart during slow start window upstream effective weight ramps linearly
+// from MinWeight fraction of upstream weight to full weight
+// so least connection method does not send all new connections to upstream with zero connections
+type SlowStart struct {
+	// in seconds, 0 disables slow start
+	Window int `yaml:"window"`
+	// initial fraction of upstream weight, (0, 1]
+	// default value 0.1
+	MinWeight float64 `yaml:"minWeight"`
+}
+
+// Pool is named group of upstream addresses
+// each address should be listed in proxy upstream addrs
+type Pool struct {
+	Name          string   `yaml:"name"`
+	UpstreamAddrs []string `yaml:"upstreamAddrs"`
 }
 
 func (c *Config) validate() error {
 	if len(c.UpstrmAddrs) <= 0 {
 		return ErrConfigWrongUpstr
 	}
+	if c.SlowStart.Window < 0 || c.SlowStart.MinWeight < 0 || c.SlowStart.MinWeight > 1 {
+		return ErrConfigWrongSlowStart
+	}
+	if c.SlowStart.MinWeight == 0 {
+		c.SlowStart.MinWeight = 0.1
+	}
+	if err := c.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+	upstrs := make(map[string]struct{}, len(c.UpstrmAddrs))
+	for _, u := range c.UpstrmAddrs {
+		if _, ok := upstrs[u]; ok || u == "" {
+			log.Printf("balancer: config: wrong or duplicated upstream addr %q", u)
+			return ErrConfigWrongUpstr
+		}
+		upstrs[u] = struct{}{}
+	}
+	pools := make(map[string]struct{}, len(c.Pools))
+	for _, p := range c.Pools {
+		if _, ok := pools[p.Name]; ok || p.Name == "" {
+			log.Printf("balancer: config: wrong or duplicated pool name %q", p.Name)
+			return ErrConfigWrongPool
+		}
+		pools[p.Name] = struct{}{}
+		// empty pool gives client with pool perms no upstreams
+		if len(p.UpstreamAddrs) == 0 {
+			log.Printf("balancer: config: pool %q has no upstream addrs", p.Name)
+			return ErrConfigWrongPool
+		}
+		for _, u := range p.UpstreamAddrs {
+			if _, ok := upstrs[u]; !ok {
+				log.Printf("balancer: config: pool %q references unknown upstream addr %q", p.Name, u)
+				return ErrConfigWrongPool
+			}
+		}
+	}
+	for _, u := range c.Drain {
+		if _, ok := upstrs[u]; !ok {
+			log.Printf("balancer: config: drain references unknown upstream addr %q", u)
+			return ErrConfigWrongUpstr
+		}
+	}
+	return nil
+}
+
+// validateClients checks that all upstreams and pools referenced by clients perms exist
+// a typo in client perms should fail loudly, empty client upstream list means all upstreams
+func (c *Config) validateClients(clients auth.Clients) error {
+	upstrs := make(map[string]struct{}, len(c.UpstrmAddrs))
+	for _, u := range c.UpstrmAddrs {
+		upstrs[u] = struct{}{}
+	}
+	pools := make(map[string]struct{}, len(c.Pools))
+	for _, p := range c.Pools {
+		pools[p.Name] = struct{}{}
+	}
+	for _, client := range clients {
+		for _, u := range client.Perms.UpstreamAddrs {
+			if _, ok := upstrs[u]; !ok {
+				log.Printf("balancer: config: client %q references unknown upstream addr %q", client.Id, u)
+				return ErrConfigClientUnknownUpstr
+			}
+		}
+		for _, p := range client.Perms.Pools {
+			if _, ok := pools[p]; !ok {
+				log.Printf("balancer: config: client %q references unknown pool %q", client.Id, p)
+				return ErrConfigClientUnknownPool
+			}
+		}
+	}
 	return nil
 }
 
 // Balancer balance using a least connection method
-// (previous version used round-robin, see history of commits)
+// upstream connections number is scaled by upstream effective weight (see slow start)
+// (previous versions used round-robin and order list sorted by connections number, see history of commits)
 type Balancer struct {
 	conf Config
 
 	// general mutex for object used to get next upstream address
 	upstrMx sync.Mutex
-	// stores number of connections of upstream address
-	upstrConnCntr []upstrConnCntr
-	// upstream indexes (in list of upstreams) ordered from less conn to max conn number
-	upstrIdxsByConnNum []int
+	// upstreams in same order as in config, then discovered upstreams
+	upstrs []*upstream
+
+	// names of configured pools (set only in New)
+	pools map[string]struct{}
 
 	// clientsBalance stores balance parameters of clients
-	// upstream address indexes by client (only for client limited by client perms)
+	// upstream addresses and pools by client (only for client limited by client perms)
 	// map key client id
 	// set only in New so no need protect with mutex
 	clientsBalance map[string]*clientBalance
@@ -45,39 +151,51 @@ func New(config Config, iauth auth.IAuth) (*Balancer, error) {
 	if err := config.validate(); err != nil {
 		return nil, err
 	}
+	if err := config.validateClients(iauth.AllClientsPerms()); err != nil {
+		return nil, err
+	}
 	b := &Balancer{
-		conf:               config,
-		upstrConnCntr:      make([]upstrConnCntr, len(config.UpstrmAddrs)),
-		upstrIdxsByConnNum: make([]int, len(config.UpstrmAddrs)),
-		clientsBalance:     make(map[string]*clientBalance),
-		auth:               iauth,
+		conf:           config,
+		upstrs:         make([]*upstream, len(config.UpstrmAddrs)),
+		pools:          make(map[string]struct{}, len(config.Pools)),
+		clientsBalance: make(map[string]*clientBalance),
+		auth:           iauth,
 	}
 	b.setBalancerParams()
 	return b, nil
 }
 
 func (b *Balancer) setBalancerParams() {
-	// set default values of upstreams idxs order
-	// in initial state all conn number is zero so we just order in same way as in in config
-	for i := 0; i < len(b.conf.UpstrmAddrs); i++ {
-		b.upstrConnCntr[i].orderIdx = i
-		b.upstrIdxsByConnNum[i] = i
+	// initial upstreams start together so they do not need slow start
+	for i, addr := range b.conf.UpstrmAddrs {
+		b.upstrs[i] = newUpstream(addr)
+		b.publishUpstreamNotSafe(b.upstrs[i])
+	}
+	// upstream pools membership
+	for _, p := range b.conf.Pools {
+		b.pools[p.Name] = struct{}{}
+		for _, addr := range p.UpstreamAddrs {
+			b.findUpstreamNotSafe(addr).pools[p.Name] = struct{}{}
+		}
+	}
+	for _, addr := range b.conf.Drain {
+		b.drainNotSafe(b.findUpstreamNotSafe(addr), 0)
 	}
 	// for each client set client balance params struct
-	// for client with upstream perms build own upstream idx list
+	// for client with upstream or pool perms set own upstream addrs and pools
+	// client with any perms reference is restricted (never falls back to all upstreams)
 	for _, client := range b.auth.AllClientsPerms() {
 		clnBlnc := &clientBalance{
-			limit:     client.Perms.Limit,
-			upstrIdxs: make(map[int]struct{}, len(client.Perms.UpstreamAddrs)),
-		}
-		// set own upstream idx
-		for _, pu := range client.Perms.UpstreamAddrs {
-			for i, u := range b.conf.UpstrmAddrs {
-				if pu == u {
-					// we need only indexes
-					clnBlnc.upstrIdxs[i] = struct{}{}
-				}
-			}
+			restricted: len(client.Perms.UpstreamAddrs) > 0 || len(client.Perms.Pools) > 0,
+			limit:      client.Perms.Limit,
+			upstrAddrs: make(map[string]struct{}, len(client.Perms.UpstreamAddrs)),
+			pools:      make(map[string]struct{}, len(client.Perms.Pools)),
+		}
+		for _, addr := range client.Perms.UpstreamAddrs {
+			clnBlnc.upstrAddrs[addr] = struct{}{}
+		}
+		for _, p := range client.Perms.Pools {
+			clnBlnc.pools[p] = struct{}{}
 		}
 		b.clientsBalance[client.Id] = clnBlnc
 	}
@@ -89,21 +207,150 @@ func (b *Balancer) setBalancerParams() {
 // if client is limited by own permissions return next address from list of client upstreams
 // check that client do not exceed limit
 func (b *Balancer) Balance(clientId string) (Upstream, error) {
-	return b.balance(clientId)
+	return b.balance(clientId, nil)
+}
+
+// BalancePool same as Balance but selects only upstreams of pool (empty pool - no restriction)
+// upstream should be allowed by client perms and be member of pool
+// return ErrUpstreamNotAllowed if client perms do not allow any upstream of pool
+func (b *Balancer) BalancePool(clientId string, pool string) (Upstream, error) {
+	if pool == "" {
+		return b.balance(clientId, nil)
+	}
+	if !b.HasPool(pool) {
+		return nil, ErrPoolNotFound
+	}
+	if clnBlnc, ok := b.clientsBalance[clientId]; ok && !b.poolAllowed(clnBlnc, pool) {
+		return nil, ErrUpstreamNotAllowed
+	}
+	return b.balance(clientId, func(u *upstream) bool {
+		_, ok := u.pools[pool]
+		return ok
+	})
+}
+
+// BalanceAddr return upstream of addr selected by client (explicit target, no balancing)
+// upstream should be allowed by client perms and be member of pool (empty pool - no restriction)
+// return ErrUpstreamNotAllowed if addr unknown or not allowed
+// ErrCanNotGetUpstream if upstream not available (draining, circuit breaker open)
+func (b *Balancer) BalanceAddr(clientId string, pool string, addr string) (Upstream, error) {
+	clnBlnc, ok := b.clientsBalance[clientId]
+	if !ok {
+		return nil, ErrClientNotConfig
+	}
+	if pool != "" && !b.HasPool(pool) {
+		return nil, ErrPoolNotFound
+	}
+	b.upstrMx.Lock()
+	u := b.findUpstreamNotSafe(addr)
+	allowed := u != nil && clnBlnc.isAllowed(u)
+	if allowed && pool != "" {
+		_, allowed = u.pools[pool]
+	}
+	b.upstrMx.Unlock()
+	if !allowed {
+		return nil, ErrUpstreamNotAllowed
+	}
+	return b.balance(clientId, func(u *upstream) bool {
+		return u.addr == addr
+	})
+}
+
+// poolAllowed reports if client perms allow at least one upstream of pool (or pool is empty)
+func (b *Balancer) poolAllowed(clnBlnc *clientBalance, pool string) bool {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	empty := true
+	for _, u := range b.upstrs {
+		if _, ok := u.pools[pool]; !ok {
+			continue
+		}
+		if clnBlnc.isAllowed(u) {
+			return true
+		}
+		empty = false
+	}
+	return empty
+}
+
+// HasPool reports if pool configured
+func (b *Balancer) HasPool(pool string) bool {
+	_, ok := b.pools[pool]
+	return ok
+}
+
+// MarkRecovered starts slow start of upstream
+// should be called when upstream becomes available again (for example by health checking)
+func (b *Balancer) MarkRecovered(addr string) error {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	u := b.findUpstreamNotSafe(addr)
+	if u == nil {
+		return ErrUpstreamNotFound
+	}
+	b.startSlowStartNotSafe(u)
+	return nil
+}
+
+// UpstreamsState return snapshot of upstreams state
+func (b *Balancer) UpstreamsState() []UpstreamState {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	now := time.Now()
+	states := make([]UpstreamState, 0, len(b.upstrs))
+	for _, u := range b.upstrs {
+		// read only, breaker transitions done by balancing
+		states = append(states, UpstreamState{
+			Addr:            u.addr,
+			Weight:          u.weight,
+			EffectiveWeight: b.effectiveWeightNotSafe(u, now),
+			Conns:           u.conns,
+			SlowStart:       !u.slowStartAt.IsZero(),
+			Breaker:         b.breakerStateNotSafe(u, now).String(),
+			Draining:        u.draining,
+			Discovered:      u.discovered,
+			Pools:           u.poolNames(),
+			Metadata:        u.metadata,
+		})
+	}
+	return states
 }
 
 // releases client from balancer stats
-func (b *Balancer) releaseUpstream(clientId string, upstrIdx int) {
-	if clnBlnc, ok := b.clientsBalance[clientId]; ok {
+func (b *Balancer) releaseUpstream(ui *upstreamImpl, sessErr error) {
+	if clnBlnc, ok := b.clientsBalance[ui.clientId]; ok {
 		// if limit set
 		if clnBlnc.limit > 0 {
 			clnBlnc.decrClient()
 		}
 	}
-	b.decrUpstr(upstrIdx)
+
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	ui.upstr.conns--
+	delete(ui.upstr.sessions, ui)
+	// session result counted only for dialed upstream
+	if !ui.dialedAt.IsZero() {
+		now := time.Now()
+		failWindow := time.Duration(b.conf.CircuitBreaker.SessionFailureMs) * time.Millisecond
+		failed := sessErr != nil && now.Sub(ui.dialedAt) < failWindow
+		b.breakerSessionNotSafe(ui.upstr, ui.trialGen, failed, now)
+	}
+}
+
+// reports upstream dial result
+func (b *Balancer) dialedUpstream(ui *upstreamImpl, err error) {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	now := time.Now()
+	if err == nil {
+		ui.dialedAt = now
+	}
+	b.breakerDialNotSafe(ui.upstr, ui.trialGen, err != nil, now)
 }
 
-func (b *Balancer) balance(clientId string) (upstr Upstream, rerr error) {
+// filter additionally restricts selected upstreams (nil - no restriction)
+func (b *Balancer) balance(clientId string, filter func(*upstream) bool) (upstr Upstream, rerr error) {
 	// use rerr only for defer
 	// always return error value explicitly
 	// return nil, error
@@ -133,88 +380,79 @@ func (b *Balancer) balance(clientId string) (upstr Upstream, rerr error) {
 	}
 
 	// next upstream address
-	upstrIdx := b.nextUpstreamIdx(clnBlnc)
-
-	// upstream
-	upstr = &upstreamImpl{
-		balancer:  b,
-		clientId:  clientId,
-		upstrAddr: b.conf.UpstrmAddrs[upstrIdx],
-		upstrIdx:  upstrIdx,
+	ui, ok := b.nextUpstream(clnBlnc, filter)
+	if !ok {
+		return nil, ErrCanNotGetUpstream
 	}
-	return upstr, nil
+	ui.clientId = clientId
+	return ui, nil
 }
 
-func (b *Balancer) nextUpstreamIdx(clnBalance *clientBalance) int {
+// nextUpstream return upstream with minimal connections number scaled by effective weight
+// if several upstreams have same value first in config order is selected
+// upstreams with open circuit breaker and drained upstreams are skipped
+func (b *Balancer) nextUpstream(clnBalance *clientBalance, filter func(*upstream) bool) (*upstreamImpl, bool) {
 	b.upstrMx.Lock()
 	defer b.upstrMx.Unlock()
 
-	upstrIdx := b.upstrIdxsByConnNum[0]
-	// if we have client specific permition list limit idx by the list
-	if len(clnBalance.upstrIdxs) > 0 {
-		for i := 0; i < len(b.upstrIdxsByConnNum); i++ {
-			upstrIdx = b.upstrIdxsByConnNum[i]
-			// at least one should be in map
-			if _, ok := clnBalance.upstrIdxs[upstrIdx]; ok {
-				break
-			}
+	now := time.Now()
+	var (
+		next    *upstream
+		minLoad float64
+	)
+	for _, u := range b.upstrs {
+		// if we have client specific permition list limit upstreams by the list
+		if !clnBalance.isAllowed(u) || (filter != nil && !filter(u)) {
+			continue
+		}
+		if u.draining || !b.breakerAllowNotSafe(u, now) {
+			continue
 		}
+		// load if upstream gets next connection
+		load := float64(u.conns+1) / b.effectiveWeightNotSafe(u, now)
+		if next == nil || load < minLoad {
+			next = u
+			minLoad = load
+		}
+	}
+	if next == nil {
+		return nil, false
 	}
 
 	// update
-	b.incrUpstrCntrNotSafe(upstrIdx)
-
-	return upstrIdx
-}
+	next.conns++
 
-func (b *Balancer) decrUpstr(upstrIdx int) {
-	b.upstrMx.Lock()
-	defer b.upstrMx.Unlock()
-	b.decrUpstrCntrNotSafe(upstrIdx)
+	ui := &upstreamImpl{
+		balancer: b,
+		upstr:    next,
+		trialGen: b.breakerSelectNotSafe(next),
+		done:     make(chan struct{}),
+	}
+	next.sessions[ui] = struct{}{}
+	return ui, true
 }
 
 // not thread-safe
-func (b *Balancer) incrUpstrCntrNotSafe(upstrIdx int) {
-	// update upstream counter
-	b.upstrConnCntr[upstrIdx].cntr++
-
-	// update order
-	// if current element in order list higher than next need swap
-	// repead for next elements
-	orderIdx := b.upstrConnCntr[upstrIdx].orderIdx
-	for i := orderIdx; i < (len(b.upstrIdxsByConnNum) - 1); i++ {
-		upstrIdx := b.upstrIdxsByConnNum[i]
-		nextUpstrIdx := b.upstrIdxsByConnNum[i+1]
-		if b.upstrConnCntr[upstrIdx].cntr > b.upstrConnCntr[nextUpstrIdx].cntr {
-			// swap
-			b.upstrIdxsByConnNum[i], b.upstrIdxsByConnNum[i+1] = b.upstrIdxsByConnNum[i+1], b.upstrIdxsByConnNum[i]
-			b.upstrConnCntr[upstrIdx].orderIdx = i + 1
-			b.upstrConnCntr[nextUpstrIdx].orderIdx = i
-		} else {
-			break
-		}
+func (b *Balancer) startSlowStartNotSafe(u *upstream) {
+	if b.conf.SlowStart.Window > 0 {
+		u.slowStartAt = time.Now()
 	}
 }
 
+// effective weight ramps linearly during slow start window
 // not thread-safe
-func (b *Balancer) decrUpstrCntrNotSafe(upstrIdx int) {
-	// update upstream counter
-	b.upstrConnCntr[upstrIdx].cntr--
-
-	// update order
-	// if current element in order list lower than prev need swap
-	// repead for prev elements
-	orderIdx := b.upstrConnCntr[upstrIdx].orderIdx
-	for i := orderIdx; i > 0; i-- {
-		upstrIdx := b.upstrIdxsByConnNum[i]
-		prevUpstrIdx := b.upstrIdxsByConnNum[i-1]
-		if b.upstrConnCntr[upstrIdx].cntr < b.upstrConnCntr[prevUpstrIdx].cntr {
-			// swap
-			b.upstrIdxsByConnNum[i], b.upstrIdxsByConnNum[i-1] = b.upstrIdxsByConnNum[i-1], b.upstrIdxsByConnNum[i]
-			b.upstrConnCntr[upstrIdx].orderIdx = i - 1
-			b.upstrConnCntr[prevUpstrIdx].orderIdx = i
-		} else {
-			break
-		}
+func (b *Balancer) effectiveWeightNotSafe(u *upstream, now time.Time) float64 {
+	if u.slowStartAt.IsZero() {
+		return u.weight
+	}
+	window := time.Duration(b.conf.SlowStart.Window) * time.Second
+	elapsed := now.Sub(u.slowStartAt)
+	if elapsed >= window || elapsed < 0 {
+		// slow start done
+		u.slowStartAt = time.Time{}
+		return u.weight
 	}
+	minW := b.conf.SlowStart.MinWeight
+	frac := minW + (1-minW)*float64(elapsed)/float64(window)
+	return u.weight * frac
 }
@@ -0,0 +1,280 @@
+package balancer
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/auth"
+)
+
+// newTestBalancer return balancer of config and clients
+func newTestBalancer(t *testing.T, conf Config, clients ...auth.Client) *Balancer {
+	t.Helper()
+	a, err := auth.New(auth.Config{Clients: clients})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(conf, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// balanceAddr return addr of balanced upstream, upstream released
+func balanceAddr(t *testing.T, b *Balancer, clientId string) (string, error) {
+	t.Helper()
+	u, err := b.Balance(clientId)
+	if err != nil {
+		return "", err
+	}
+	defer u.Close(nil)
+	return u.Addr(), nil
+}
+
+func TestConfigValidatePools(t *testing.T) {
+	tests := []struct {
+		name  string
+		pools []Pool
+		err   error
+	}{
+		{name: "ok", pools: []Pool{{Name: "p1", UpstreamAddrs: []string{"u1"}}}},
+		{name: "empty pool", pools: []Pool{{Name: "p1"}}, err: ErrConfigWrongPool},
+		{name: "no name", pools: []Pool{{UpstreamAddrs: []string{"u1"}}}, err: ErrConfigWrongPool},
+		{name: "unknown addr", pools: []Pool{{Name: "p1", UpstreamAddrs: []string{"u3"}}}, err: ErrConfigWrongPool},
+		{
+			name:  "duplicated",
+			pools: []Pool{{Name: "p1", UpstreamAddrs: []string{"u1"}}, {Name: "p1", UpstreamAddrs: []string{"u2"}}},
+			err:   ErrConfigWrongPool,
+		},
+	}
+	for _, tt := range tests {
+		conf := Config{UpstrmAddrs: []string{"u1", "u2"}, Pools: tt.pools}
+		if err := conf.validate(); !errors.Is(err, tt.err) {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestConfigValidateClients(t *testing.T) {
+	conf := Config{UpstrmAddrs: []string{"u1"}, Pools: []Pool{{Name: "p1", UpstreamAddrs: []string{"u1"}}}}
+	tests := []struct {
+		perms auth.Perms
+		err   error
+	}{
+		{perms: auth.Perms{}},
+		{perms: auth.Perms{UpstreamAddrs: []string{"u1"}, Pools: []string{"p1"}}},
+		{perms: auth.Perms{UpstreamAddrs: []string{"u2"}}, err: ErrConfigClientUnknownUpstr},
+		{perms: auth.Perms{Pools: []string{"p2"}}, err: ErrConfigClientUnknownPool},
+	}
+	for _, tt := range tests {
+		clients := auth.Clients{{Id: "c", Perms: tt.perms}}
+		if err := conf.validateClients(clients); !errors.Is(err, tt.err) {
+			t.Errorf("perms %+v: error %v, want %v", tt.perms, err, tt.err)
+		}
+	}
+}
+
+func TestClientBalanceIsAllowed(t *testing.T) {
+	u1, u2 := newUpstream("u1"), newUpstream("u2")
+	u2.pools["p1"] = struct{}{}
+	tests := []struct {
+		name   string
+		client *clientBalance
+		want   [2]bool
+	}{
+		{name: "not restricted", client: &clientBalance{}, want: [2]bool{true, true}},
+		{
+			name:   "addr",
+			client: &clientBalance{restricted: true, upstrAddrs: map[string]struct{}{"u1": {}}},
+			want:   [2]bool{true, false},
+		},
+		{
+			name:   "pool",
+			client: &clientBalance{restricted: true, pools: map[string]struct{}{"p1": {}}},
+			want:   [2]bool{false, true},
+		},
+		// restricted client with no resolved upstreams does not fall back to all upstreams
+		{name: "restricted empty", client: &clientBalance{restricted: true}, want: [2]bool{false, false}},
+	}
+	for _, tt := range tests {
+		got := [2]bool{tt.client.isAllowed(u1), tt.client.isAllowed(u2)}
+		if got != tt.want {
+			t.Errorf("%v: allowed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBalanceRestrictedClients(t *testing.T) {
+	conf := Config{
+		UpstrmAddrs: []string{"u1", "u2", "u3"},
+		Pools: []Pool{
+			{Name: "p1", UpstreamAddrs: []string{"u1", "u2"}},
+			{Name: "p2", UpstreamAddrs: []string{"u3"}},
+		},
+	}
+	b := newTestBalancer(t, conf,
+		auth.Client{Id: "all"},
+		auth.Client{Id: "addr", Perms: auth.Perms{UpstreamAddrs: []string{"u2"}}},
+		auth.Client{Id: "pool", Perms: auth.Perms{Pools: []string{"p2"}}},
+	)
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		u, err := b.Balance("all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// not released, so next balance selects other upstream
+		defer u.Close(nil)
+		seen[u.Addr()] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("not restricted client upstreams %v, want all", seen)
+	}
+	for client, want := range map[string]string{"addr": "u2", "pool": "u3"} {
+		for i := 0; i < 3; i++ {
+			addr, err := balanceAddr(t, b, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr != want {
+				t.Fatalf("client %v upstream %v, want %v", client, addr, want)
+			}
+		}
+	}
+
+	if _, err := b.BalancePool("addr", "p2"); !errors.Is(err, ErrUpstreamNotAllowed) {
+		t.Fatalf("balance not allowed pool: error %v, want %v", err, ErrUpstreamNotAllowed)
+	}
+	if _, err := b.BalancePool("addr", "p3"); !errors.Is(err, ErrPoolNotFound) {
+		t.Fatalf("balance unknown pool: error %v, want %v", err, ErrPoolNotFound)
+	}
+	u, err := b.BalancePool("addr", "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Addr() != "u2" {
+		t.Fatalf("client upstream of pool %v, want u2", u.Addr())
+	}
+	u.Close(nil)
+	if _, err := b.BalanceAddr("pool", "", "u1"); !errors.Is(err, ErrUpstreamNotAllowed) {
+		t.Fatalf("balance not allowed addr: error %v, want %v", err, ErrUpstreamNotAllowed)
+	}
+	if _, err := b.Balance("unknown"); !errors.Is(err, ErrClientNotConfig) {
+		t.Fatalf("balance unknown client: error %v, want %v", err, ErrClientNotConfig)
+	}
+}
+
+func TestBalanceClientLimit(t *testing.T) {
+	b := newTestBalancer(t, Config{UpstrmAddrs: []string{"u1"}}, auth.Client{Id: "c", Perms: auth.Perms{Limit: 1}})
+	u, err := b.Balance("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Balance("c"); !errors.Is(err, ErrClientExceedLimti) {
+		t.Fatalf("error %v, want %v", err, ErrClientExceedLimti)
+	}
+	u.Close(nil)
+	if _, err := balanceAddr(t, b, "c"); err != nil {
+		t.Fatalf("limit not released: %v", err)
+	}
+}
+
+func TestBalanceLeastConnections(t *testing.T) {
+	b := newTestBalancer(t, Config{UpstrmAddrs: []string{"u1", "u2"}}, auth.Client{Id: "c"})
+	var held []Upstream
+	balance := func() string {
+		u, err := b.Balance("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, u)
+		return u.Addr()
+	}
+	// same load, first in config order selected
+	if got := []string{balance(), balance(), balance()}; got[0] != "u1" || got[1] != "u2" || got[2] != "u1" {
+		t.Fatalf("upstreams %v, want [u1 u2 u1]", got)
+	}
+	// u1 released, u1 has less connections
+	held[0].Close(nil)
+	held[2].Close(nil)
+	if got := balance(); got != "u1" {
+		t.Fatalf("upstream %v, want u1", got)
+	}
+
+	// weight scales connections, u2 with double weight gets two connections per u1 connection
+	b = newTestBalancer(t, Config{UpstrmAddrs: []string{"u1", "u2"}}, auth.Client{Id: "c"})
+	b.findUpstreamNotSafe("u2").weight = 2
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		counts[balance()]++
+	}
+	if counts["u1"] != 2 || counts["u2"] != 4 {
+		t.Fatalf("upstream connections %v, want u1 2, u2 4", counts)
+	}
+}
+
+func TestSlowStartEffectiveWeight(t *testing.T) {
+	b := newTestBalancer(t, Config{
+		UpstrmAddrs: []string{"u1"},
+		SlowStart:   SlowStart{Window: 10, MinWeight: 0.2},
+	})
+	u := b.findUpstreamNotSafe("u1")
+	u.weight = 2
+	// initial upstreams do not slow start
+	now := time.Now()
+	if w := b.effectiveWeightNotSafe(u, now); w != 2 {
+		t.Fatalf("initial upstream weight %v, want 2", w)
+	}
+
+	if err := b.MarkRecovered("u1"); err != nil {
+		t.Fatal(err)
+	}
+	start := u.slowStartAt
+	tests := []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{elapsed: 0, want: 0.4},
+		{elapsed: 5 * time.Second, want: 1.2},
+		{elapsed: 10 * time.Second, want: 2},
+	}
+	for _, tt := range tests {
+		if w := b.effectiveWeightNotSafe(u, start.Add(tt.elapsed)); math.Abs(w-tt.want) > 1e-9 {
+			t.Errorf("weight after %v: %v, want %v", tt.elapsed, w, tt.want)
+		}
+	}
+	// slow start done after window
+	if !u.slowStartAt.IsZero() {
+		t.Fatal("slow start not done after window")
+	}
+	if err := b.MarkRecovered("u3"); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Fatalf("error %v, want %v", err, ErrUpstreamNotFound)
+	}
+}
+
+// upstream in slow start gets share of new connections by its ramped weight
+func TestSlowStartBalance(t *testing.T) {
+	b := newTestBalancer(t, Config{
+		UpstrmAddrs: []string{"u1", "u2"},
+		SlowStart:   SlowStart{Window: 3600, MinWeight: 0.25},
+	}, auth.Client{Id: "c"})
+	if err := b.MarkRecovered("u2"); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		u, err := b.Balance("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer u.Close(nil)
+		counts[u.Addr()]++
+	}
+	if counts["u1"] != 8 || counts["u2"] != 2 {
+		t.Fatalf("upstream connections %v, want u1 8, u2 2", counts)
+	}
+}
@@ -0,0 +1,243 @@
+package balancer
+
+import (
+	"log"
+	"time"
+)
+
+// CircuitBreaker config of upstream circuit breaker
+// breaker opens when upstream dial error rate or session failure rate in window exceeds FailureRate
+// (session failure is session closed with upstream side error within SessionFailureMs after dial,
+// client side errors are not upstream failures)
+// open breaker excludes upstream from balancing for OpenDuration
+// then breaker goes half-open and allows limited trial connections
+// if all trials succeed breaker closes, any trial failure opens breaker again
+type CircuitBreaker struct {
+	Enabled bool `yaml:"enabled"`
+	// in seconds
+	// default value 10s
+	Window int `yaml:"window"`
+	// min number of dials (or sessions) in window to evaluate rate
+	// default value 5
+	MinRequests int `yaml:"minRequests"`
+	// (0, 1]
+	// default value 0.5
+	FailureRate float64 `yaml:"failureRate"`
+	// in milliseconds
+	// default value 1000ms
+	SessionFailureMs int `yaml:"sessionFailureMs"`
+	// in seconds
+	// default value 30s
+	OpenDuration int `yaml:"openDuration"`
+	// number of trial connections in half-open state
+	// default value 1
+	HalfOpenTrials int `yaml:"halfOpenTrials"`
+}
+
+func (c *CircuitBreaker) validate() error {
+	if c.Window < 0 || c.MinRequests < 0 || c.FailureRate < 0 || c.FailureRate > 1 ||
+		c.SessionFailureMs < 0 || c.OpenDuration < 0 || c.HalfOpenTrials < 0 {
+		return ErrConfigWrongCircuitBreaker
+	}
+	if c.Window == 0 {
+		c.Window = 10
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 5
+	}
+	if c.FailureRate == 0 {
+		c.FailureRate = 0.5
+	}
+	if c.SessionFailureMs == 0 {
+		c.SessionFailureMs = 1000
+	}
+	if c.OpenDuration == 0 {
+		c.OpenDuration = 30
+	}
+	if c.HalfOpenTrials == 0 {
+		c.HalfOpenTrials = 1
+	}
+	return nil
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker state of upstream
+// not thread-safe, protected by balancer upstream mutex
+type breaker struct {
+	state BreakerState
+
+	// window counters (reset when window expired)
+	windowStart  time.Time
+	dials        int
+	dialFails    int
+	sessions     int
+	sessionFails int
+
+	// open state begin time
+	openedAt time.Time
+	// half-open generation, increments each time breaker goes half-open
+	// used to ignore results of trials from previous half-open states
+	gen int
+	// half-open trials in progress and succeeded
+	trials         int
+	trialSuccesses int
+}
+
+// not thread-safe
+// breakerAllowNotSafe reports if upstream can be selected
+func (b *Balancer) breakerAllowNotSafe(u *upstream, now time.Time) bool {
+	conf := b.conf.CircuitBreaker
+	if !conf.Enabled {
+		return true
+	}
+	br := &u.breaker
+	if br.state == BreakerOpen && b.breakerStateNotSafe(u, now) == BreakerHalfOpen {
+		b.setBreakerStateNotSafe(u, BreakerHalfOpen)
+	}
+	switch br.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return br.trials < conf.HalfOpenTrials
+	default:
+		return false
+	}
+}
+
+// not thread-safe
+// breakerStateNotSafe return breaker state at now without transition (open breaker shown half-open after open duration)
+func (b *Balancer) breakerStateNotSafe(u *upstream, now time.Time) BreakerState {
+	conf := b.conf.CircuitBreaker
+	br := &u.breaker
+	if conf.Enabled && br.state == BreakerOpen && now.Sub(br.openedAt) >= time.Duration(conf.OpenDuration)*time.Second {
+		return BreakerHalfOpen
+	}
+	return br.state
+}
+
+// not thread-safe
+// breakerSelectNotSafe registers selected connection
+// return half-open generation if connection is trial (0 if not trial)
+func (b *Balancer) breakerSelectNotSafe(u *upstream) int {
+	if !b.conf.CircuitBreaker.Enabled || u.breaker.state != BreakerHalfOpen {
+		return 0
+	}
+	u.breaker.trials++
+	return u.breaker.gen
+}
+
+// not thread-safe
+func (b *Balancer) breakerDialNotSafe(u *upstream, trialGen int, failed bool, now time.Time) {
+	if !b.conf.CircuitBreaker.Enabled {
+		return
+	}
+	br := &u.breaker
+	b.breakerWindowNotSafe(br, now)
+	br.dials++
+	if failed {
+		br.dialFails++
+	}
+	b.breakerResultNotSafe(u, trialGen, failed, !failed)
+}
+
+// not thread-safe
+// record session result
+func (b *Balancer) breakerSessionNotSafe(u *upstream, trialGen int, failed bool, now time.Time) {
+	if !b.conf.CircuitBreaker.Enabled {
+		return
+	}
+	br := &u.breaker
+	b.breakerWindowNotSafe(br, now)
+	br.sessions++
+	if failed {
+		br.sessionFails++
+	}
+	b.breakerResultNotSafe(u, trialGen, failed, false)
+}
+
+// not thread-safe
+// pending is true if trial is not done yet (dial succeeded, session result expected)
+func (b *Balancer) breakerResultNotSafe(u *upstream, trialGen int, failed bool, pending bool) {
+	conf := b.conf.CircuitBreaker
+	br := &u.breaker
+	if trialGen != 0 {
+		if br.state != BreakerHalfOpen || br.gen != trialGen {
+			// trial of previous half-open state
+			return
+		}
+		if failed {
+			b.setBreakerStateNotSafe(u, BreakerOpen)
+			return
+		}
+		if pending {
+			return
+		}
+		br.trials--
+		br.trialSuccesses++
+		if br.trialSuccesses >= conf.HalfOpenTrials {
+			b.setBreakerStateNotSafe(u, BreakerClosed)
+		}
+		return
+	}
+	if br.state != BreakerClosed || !failed {
+		return
+	}
+	overRate := func(total, fails int) bool {
+		return total >= conf.MinRequests && float64(fails)/float64(total) >= conf.FailureRate
+	}
+	if overRate(br.dials, br.dialFails) || overRate(br.sessions, br.sessionFails) {
+		b.setBreakerStateNotSafe(u, BreakerOpen)
+	}
+}
+
+// not thread-safe
+func (b *Balancer) breakerWindowNotSafe(br *breaker, now time.Time) {
+	window := time.Duration(b.conf.CircuitBreaker.Window) * time.Second
+	if now.Sub(br.windowStart) >= window {
+		br.windowStart = now
+		br.dials, br.dialFails, br.sessions, br.sessionFails = 0, 0, 0, 0
+	}
+}
+
+// not thread-safe
+func (b *Balancer) setBreakerStateNotSafe(u *upstream, state BreakerState) {
+	br := &u.breaker
+	if br.state == state {
+		return
+	}
+	log.Printf("balancer: upstream %v: circuit breaker %v -> %v", u.addr, br.state, state)
+	metricBreakerTransitions.Add(u.addr+":"+state.String(), 1)
+	br.state = state
+	switch state {
+	case BreakerOpen:
+		br.openedAt = time.Now()
+	case BreakerHalfOpen:
+		br.gen++
+		br.trials, br.trialSuccesses = 0, 0
+	case BreakerClosed:
+		br.windowStart = time.Time{}
+		// recovered upstream
+		b.startSlowStartNotSafe(u)
+	}
+	b.publishUpstreamNotSafe(u)
+}
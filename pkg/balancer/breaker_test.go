@@ -0,0 +1,205 @@
+package balancer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/auth"
+)
+
+var errTestSession = errors.New("upstream reset")
+
+// newBreakerBalancer return balancer of one upstream u1 with circuit breaker
+// breaker opens on two failures of two requests, one half-open trial
+func newBreakerBalancer(t *testing.T) (*Balancer, *upstream) {
+	t.Helper()
+	b := newTestBalancer(t, Config{
+		UpstrmAddrs: []string{"u1"},
+		CircuitBreaker: CircuitBreaker{
+			Enabled:     true,
+			MinRequests: 2,
+			FailureRate: 1,
+		},
+	}, auth.Client{Id: "c"})
+	return b, b.findUpstreamNotSafe("u1")
+}
+
+// openBreaker opens breaker by dial failures
+func openBreaker(t *testing.T, b *Balancer) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		u, err := b.Balance("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Dialed(errTestSession)
+		u.Close(nil)
+	}
+}
+
+// afterOpen return time when open breaker goes half-open
+func afterOpen(b *Balancer, u *upstream) time.Time {
+	return u.breaker.openedAt.Add(time.Duration(b.conf.CircuitBreaker.OpenDuration) * time.Second)
+}
+
+func TestBreakerOpensOnDialFailures(t *testing.T) {
+	b, u := newBreakerBalancer(t)
+	// one failure less than min requests
+	ui, err := b.Balance("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui.Dialed(errTestSession)
+	ui.Close(nil)
+	if u.breaker.state != BreakerClosed {
+		t.Fatalf("breaker %v, want closed", u.breaker.state)
+	}
+
+	ui, err = b.Balance("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui.Dialed(errTestSession)
+	ui.Close(nil)
+	if u.breaker.state != BreakerOpen {
+		t.Fatalf("breaker %v, want open", u.breaker.state)
+	}
+	if _, err := b.Balance("c"); !errors.Is(err, ErrCanNotGetUpstream) {
+		t.Fatalf("open breaker upstream selected: error %v", err)
+	}
+}
+
+func TestBreakerOpensOnSessionFailures(t *testing.T) {
+	b, u := newBreakerBalancer(t)
+	session := func(sessErr error) {
+		ui, err := b.Balance("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ui.Dialed(nil)
+		ui.Close(sessErr)
+	}
+	// sessions closed normally (or by client side errors) are not failures
+	session(nil)
+	session(nil)
+	if u.breaker.state != BreakerClosed {
+		t.Fatalf("breaker %v, want closed", u.breaker.state)
+	}
+	// window reset, so failures rate evaluated on failed sessions only
+	u.breaker.windowStart = time.Time{}
+	session(errTestSession)
+	session(errTestSession)
+	if u.breaker.state != BreakerOpen {
+		t.Fatalf("breaker %v, want open", u.breaker.state)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, u := newBreakerBalancer(t)
+	openBreaker(t, b)
+
+	now := time.Now()
+	if b.breakerAllowNotSafe(u, now) {
+		t.Fatal("open breaker allows upstream before open duration")
+	}
+	halfOpenAt := afterOpen(b, u)
+	// snapshot shows half-open without transition
+	if s := b.breakerStateNotSafe(u, halfOpenAt); s != BreakerHalfOpen {
+		t.Fatalf("breaker state %v, want half-open", s)
+	}
+	if u.breaker.state != BreakerOpen {
+		t.Fatalf("breaker state read changed breaker to %v", u.breaker.state)
+	}
+
+	// open duration passed, one trial allowed
+	if !b.breakerAllowNotSafe(u, halfOpenAt) || u.breaker.state != BreakerHalfOpen {
+		t.Fatalf("breaker %v does not allow trial after open duration", u.breaker.state)
+	}
+	gen := b.breakerSelectNotSafe(u)
+	if gen == 0 {
+		t.Fatal("selected upstream is not trial")
+	}
+	if b.breakerAllowNotSafe(u, halfOpenAt) {
+		t.Fatal("half-open breaker allows more than half-open trials")
+	}
+	// dial succeeded, breaker waits session result
+	b.breakerDialNotSafe(u, gen, false, halfOpenAt)
+	if u.breaker.state != BreakerHalfOpen {
+		t.Fatalf("breaker %v, want half-open until trial session done", u.breaker.state)
+	}
+	b.breakerSessionNotSafe(u, gen, false, halfOpenAt)
+	if u.breaker.state != BreakerClosed {
+		t.Fatalf("breaker %v, want closed after trial succeeded", u.breaker.state)
+	}
+}
+
+func TestBreakerTrialFailure(t *testing.T) {
+	b, u := newBreakerBalancer(t)
+	openBreaker(t, b)
+	if !b.breakerAllowNotSafe(u, afterOpen(b, u)) {
+		t.Fatal("breaker does not allow trial after open duration")
+	}
+	gen := b.breakerSelectNotSafe(u)
+	b.breakerDialNotSafe(u, gen, false, time.Now())
+	b.breakerSessionNotSafe(u, gen, true, time.Now())
+	if u.breaker.state != BreakerOpen {
+		t.Fatalf("breaker %v, want open after trial failed", u.breaker.state)
+	}
+}
+
+// results of trials from previous half-open state ignored
+func TestBreakerStaleTrial(t *testing.T) {
+	b, u := newBreakerBalancer(t)
+	openBreaker(t, b)
+	b.breakerAllowNotSafe(u, afterOpen(b, u))
+	staleGen := b.breakerSelectNotSafe(u)
+	// trial dial fails, breaker opens, then goes half-open again
+	b.breakerDialNotSafe(u, staleGen, true, time.Now())
+	b.breakerAllowNotSafe(u, afterOpen(b, u))
+	if u.breaker.state != BreakerHalfOpen || u.breaker.gen == staleGen {
+		t.Fatalf("breaker %v gen %v, want half-open of new generation", u.breaker.state, u.breaker.gen)
+	}
+
+	// stale trial session success does not close breaker
+	b.breakerSessionNotSafe(u, staleGen, false, time.Now())
+	if u.breaker.state != BreakerHalfOpen || u.breaker.trialSuccesses != 0 {
+		t.Fatalf("breaker %v successes %v, stale trial counted", u.breaker.state, u.breaker.trialSuccesses)
+	}
+	// stale trial failure does not open breaker
+	b.breakerSessionNotSafe(u, staleGen, true, time.Now())
+	if u.breaker.state != BreakerHalfOpen {
+		t.Fatalf("breaker %v, stale trial failure counted", u.breaker.state)
+	}
+}
+
+// upstreams state snapshot does not transition breaker
+func TestUpstreamsStateReadOnly(t *testing.T) {
+	b, u := newBreakerBalancer(t)
+	openBreaker(t, b)
+	// open duration passed
+	u.breaker.openedAt = u.breaker.openedAt.Add(-time.Duration(b.conf.CircuitBreaker.OpenDuration) * time.Second)
+	states := b.UpstreamsState()
+	if len(states) != 1 || states[0].Breaker != BreakerHalfOpen.String() {
+		t.Fatalf("states %+v, want half-open breaker", states)
+	}
+	if u.breaker.state != BreakerOpen {
+		t.Fatalf("snapshot changed breaker to %v", u.breaker.state)
+	}
+}
+
+func TestCircuitBreakerValidate(t *testing.T) {
+	conf := CircuitBreaker{}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Window != 10 || conf.MinRequests != 5 || conf.FailureRate != 0.5 ||
+		conf.SessionFailureMs != 1000 || conf.OpenDuration != 30 || conf.HalfOpenTrials != 1 {
+		t.Fatalf("defaults not set %+v", conf)
+	}
+	for _, c := range []CircuitBreaker{{Window: -1}, {FailureRate: 1.5}, {HalfOpenTrials: -1}} {
+		if err := c.validate(); !errors.Is(err, ErrConfigWrongCircuitBreaker) {
+			t.Errorf("config %+v: error %v, want %v", c, err, ErrConfigWrongCircuitBreaker)
+		}
+	}
+}
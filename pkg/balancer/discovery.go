@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"log"
+	"sort"
+)
+
+// SetUpstreams replaces discovered upstreams by entries
+// upstreams from config are not changed
+// unchanged upstreams keep connection counters and state, new upstreams start with slow start
+// removed upstreams are not selected anymore, existing sessions continue
+// entries validated before apply, on error upstreams are not changed
+func (b *Balancer) SetUpstreams(entries []UpstreamEntry) error {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+
+	if err := b.validateEntriesNotSafe(entries); err != nil {
+		return err
+	}
+
+	current := make(map[string]*upstream, len(b.upstrs))
+	upstrs := make([]*upstream, 0, len(b.upstrs)+len(entries))
+	for _, u := range b.upstrs {
+		if u.discovered {
+			current[u.addr] = u
+		} else {
+			upstrs = append(upstrs, u)
+		}
+	}
+
+	for _, e := range entries {
+		u, ok := current[e.Addr]
+		if ok {
+			delete(current, e.Addr)
+		} else {
+			log.Printf("balancer: discovery: add upstream %v", e.Addr)
+			u = newUpstream(e.Addr)
+			u.discovered = true
+			b.startSlowStartNotSafe(u)
+		}
+		u.weight = e.Weight
+		if u.weight == 0 {
+			u.weight = 1
+		}
+		u.pools = make(map[string]struct{}, 1)
+		if e.Pool != "" {
+			u.pools[e.Pool] = struct{}{}
+		}
+		u.metadata = e.Metadata
+		upstrs = append(upstrs, u)
+		b.publishUpstreamNotSafe(u)
+	}
+
+	// removed upstreams, sessions keep pointer to upstream and release it on close
+	// (drain timer of removed upstream still force closes its sessions)
+	for addr, u := range current {
+		log.Printf("balancer: discovery: remove upstream %v, sessions %v", addr, u.conns)
+		metricBreakerState.Delete(addr)
+	}
+
+	b.upstrs = upstrs
+	return nil
+}
+
+// not thread-safe
+func (b *Balancer) validateEntriesNotSafe(entries []UpstreamEntry) error {
+	static := make(map[string]struct{}, len(b.conf.UpstrmAddrs))
+	for _, addr := range b.conf.UpstrmAddrs {
+		static[addr] = struct{}{}
+	}
+	seen := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		if e.Addr == "" || e.Weight < 0 {
+			log.Printf("balancer: discovery: wrong upstream entry %+v", e)
+			return ErrDiscoveryWrongUpstr
+		}
+		if _, ok := seen[e.Addr]; ok {
+			log.Printf("balancer: discovery: duplicated upstream addr %q", e.Addr)
+			return ErrDiscoveryWrongUpstr
+		}
+		if _, ok := static[e.Addr]; ok {
+			log.Printf("balancer: discovery: upstream addr %q already in config", e.Addr)
+			return ErrDiscoveryWrongUpstr
+		}
+		seen[e.Addr] = struct{}{}
+		if e.Pool != "" {
+			if _, ok := b.pools[e.Pool]; !ok {
+				log.Printf("balancer: discovery: upstream %q references unknown pool %q", e.Addr, e.Pool)
+				return ErrDiscoveryUnknownPool
+			}
+		}
+	}
+	return nil
+}
+
+// upstreamPools return upstream pool names
+func (b *Balancer) upstreamPools(u *upstream) []string {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	return u.poolNames()
+}
+
+// not thread-safe
+func (u *upstream) poolNames() []string {
+	if len(u.pools) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(u.pools))
+	for p := range u.pools {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names
+}
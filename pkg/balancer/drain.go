@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"log"
+	"time"
+)
+
+// Drain stops selecting upstream for new connections, existing sessions continue
+// if timeout > 0 remaining sessions are force closed after timeout
+// return number of remaining sessions
+func (b *Balancer) Drain(addr string, timeout time.Duration) (int, error) {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	u := b.findUpstreamNotSafe(addr)
+	if u == nil {
+		return 0, ErrUpstreamNotFound
+	}
+	b.drainNotSafe(u, timeout)
+	return u.conns, nil
+}
+
+// Undrain returns drained upstream to balancing (with slow start)
+func (b *Balancer) Undrain(addr string) error {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	u := b.findUpstreamNotSafe(addr)
+	if u == nil {
+		return ErrUpstreamNotFound
+	}
+	if !u.draining {
+		return nil
+	}
+	log.Printf("balancer: upstream %v: undrain", u.addr)
+	u.draining = false
+	if u.drainTimer != nil {
+		u.drainTimer.Stop()
+		u.drainTimer = nil
+	}
+	b.startSlowStartNotSafe(u)
+	return nil
+}
+
+// not thread-safe
+func (b *Balancer) drainNotSafe(u *upstream, timeout time.Duration) {
+	log.Printf("balancer: upstream %v: drain, sessions %v, timeout %v", u.addr, u.conns, timeout)
+	u.draining = true
+	if u.drainTimer != nil {
+		u.drainTimer.Stop()
+		u.drainTimer = nil
+	}
+	if timeout > 0 {
+		u.drainTimer = time.AfterFunc(timeout, func() { b.forceCloseSessions(u) })
+	}
+}
+
+// force closes sessions of drained upstream
+func (b *Balancer) forceCloseSessions(u *upstream) {
+	b.upstrMx.Lock()
+	defer b.upstrMx.Unlock()
+	// undrained before timer fired
+	if !u.draining {
+		return
+	}
+	log.Printf("balancer: upstream %v: drain timeout, force close sessions %v", u.addr, len(u.sessions))
+	for ui := range u.sessions {
+		close(ui.done)
+		delete(u.sessions, ui)
+	}
+	u.drainTimer = nil
+}
+
+// not thread-safe
+func (b *Balancer) findUpstreamNotSafe(addr string) *upstream {
+	for _, u := range b.upstrs {
+		if u.addr == addr {
+			return u
+		}
+	}
+	return nil
+}
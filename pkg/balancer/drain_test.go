@@ -0,0 +1,113 @@
+package balancer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/auth"
+)
+
+func TestDrain(t *testing.T) {
+	b := newTestBalancer(t, Config{UpstrmAddrs: []string{"u1", "u2"}}, auth.Client{Id: "c"})
+	u1, err := b.Balance("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u1.Close(nil)
+	if u1.Addr() != "u1" {
+		t.Fatalf("upstream %v, want u1", u1.Addr())
+	}
+
+	n, err := b.Drain("u1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("drain remaining sessions %v, want 1", n)
+	}
+	// drained upstream not selected though it has less connections
+	for i := 0; i < 3; i++ {
+		u, err := b.Balance("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer u.Close(nil)
+		if u.Addr() != "u2" {
+			t.Fatalf("drained upstream selected")
+		}
+	}
+	if _, err := b.BalanceAddr("c", "", "u1"); !errors.Is(err, ErrCanNotGetUpstream) {
+		t.Fatalf("drained upstream selected by addr: error %v", err)
+	}
+	// no timeout, existing session not closed
+	select {
+	case <-u1.Done():
+		t.Fatal("session of drained upstream closed without timeout")
+	default:
+	}
+
+	if err := b.Undrain("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := balanceAddr(t, b, "c"); err != nil || addr != "u1" {
+		t.Fatalf("undrained upstream %v (error %v), want u1", addr, err)
+	}
+	if _, err := b.Drain("u3", 0); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Fatalf("error %v, want %v", err, ErrUpstreamNotFound)
+	}
+	if err := b.Undrain("u3"); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Fatalf("error %v, want %v", err, ErrUpstreamNotFound)
+	}
+}
+
+func TestDrainForceClose(t *testing.T) {
+	b := newTestBalancer(t, Config{UpstrmAddrs: []string{"u1"}}, auth.Client{Id: "c"})
+	u, err := b.Balance("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close(nil)
+	if _, err := b.Drain("u1", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-u.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not force closed after drain timeout")
+	}
+}
+
+// undrained upstream sessions not force closed by previous drain timeout
+func TestUndrainStopsForceClose(t *testing.T) {
+	b := newTestBalancer(t, Config{UpstrmAddrs: []string{"u1"}}, auth.Client{Id: "c"})
+	u, err := b.Balance("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close(nil)
+	if _, err := b.Drain("u1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Undrain("u1"); err != nil {
+		t.Fatal(err)
+	}
+	// timer fired after undrain
+	b.forceCloseSessions(b.findUpstreamNotSafe("u1"))
+	select {
+	case <-u.Done():
+		t.Fatal("session of undrained upstream force closed")
+	default:
+	}
+}
+
+func TestDrainOnStart(t *testing.T) {
+	b := newTestBalancer(t, Config{UpstrmAddrs: []string{"u1", "u2"}, Drain: []string{"u1"}}, auth.Client{Id: "c"})
+	if addr, err := balanceAddr(t, b, "c"); err != nil || addr != "u2" {
+		t.Fatalf("upstream %v (error %v), want u2", addr, err)
+	}
+	conf := Config{UpstrmAddrs: []string{"u1"}, Drain: []string{"u2"}}
+	if err := conf.validate(); !errors.Is(err, ErrConfigWrongUpstr) {
+		t.Fatalf("error %v, want %v", err, ErrConfigWrongUpstr)
+	}
+}
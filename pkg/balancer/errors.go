@@ -7,6 +7,16 @@ const (
 	ErrKindClientExceedLimti
 	ErrKindCanNotGetUpstream
 	ErrKindConfigWrongUpstr
+	ErrKindConfigWrongPool
+	ErrKindConfigClientUnknownUpstr
+	ErrKindConfigClientUnknownPool
+	ErrKindConfigWrongSlowStart
+	ErrKindUpstreamNotFound
+	ErrKindConfigWrongCircuitBreaker
+	ErrKindDiscoveryWrongUpstr
+	ErrKindDiscoveryUnknownPool
+	ErrKindPoolNotFound
+	ErrKindUpstreamNotAllowed
 )
 
 var (
@@ -14,6 +24,21 @@ var (
 	ErrClientExceedLimti = BalancerError{Kind: ErrKindClientExceedLimti}
 	ErrCanNotGetUpstream = BalancerError{Kind: ErrKindCanNotGetUpstream}
 	ErrConfigWrongUpstr  = BalancerError{Kind: ErrKindConfigWrongUpstr}
+	ErrConfigWrongPool   = BalancerError{Kind: ErrKindConfigWrongPool}
+
+	ErrConfigClientUnknownUpstr = BalancerError{Kind: ErrKindConfigClientUnknownUpstr}
+	ErrConfigClientUnknownPool  = BalancerError{Kind: ErrKindConfigClientUnknownPool}
+	ErrConfigWrongSlowStart     = BalancerError{Kind: ErrKindConfigWrongSlowStart}
+
+	ErrConfigWrongCircuitBreaker = BalancerError{Kind: ErrKindConfigWrongCircuitBreaker}
+
+	ErrUpstreamNotFound = BalancerError{Kind: ErrKindUpstreamNotFound}
+	ErrPoolNotFound     = BalancerError{Kind: ErrKindPoolNotFound}
+
+	ErrUpstreamNotAllowed = BalancerError{Kind: ErrKindUpstreamNotAllowed}
+
+	ErrDiscoveryWrongUpstr  = BalancerError{Kind: ErrKindDiscoveryWrongUpstr}
+	ErrDiscoveryUnknownPool = BalancerError{Kind: ErrKindDiscoveryUnknownPool}
 )
 
 func getErrorMessage(kind int) string {
@@ -26,6 +51,26 @@ func getErrorMessage(kind int) string {
 		return "can not get next upstream"
 	case ErrKindConfigWrongUpstr:
 		return "config, wrong upstream address"
+	case ErrKindConfigWrongPool:
+		return "config, wrong upstream pool"
+	case ErrKindConfigClientUnknownUpstr:
+		return "config, client references unknown upstream address"
+	case ErrKindConfigClientUnknownPool:
+		return "config, client references unknown upstream pool"
+	case ErrKindConfigWrongSlowStart:
+		return "config, wrong slow start params"
+	case ErrKindUpstreamNotFound:
+		return "upstream not found"
+	case ErrKindConfigWrongCircuitBreaker:
+		return "config, wrong circuit breaker params"
+	case ErrKindDiscoveryWrongUpstr:
+		return "discovery, wrong or duplicated upstream"
+	case ErrKindDiscoveryUnknownPool:
+		return "discovery, upstream references unknown pool"
+	case ErrKindPoolNotFound:
+		return "pool not found"
+	case ErrKindUpstreamNotAllowed:
+		return "upstream not allowed"
 	default:
 		return "unknown"
 	}
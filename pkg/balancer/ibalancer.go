@@ -1,5 +1,22 @@
 package balancer
 
+import "time"
+
 type IBalancer interface {
 	Balance(string) (Upstream, error)
+	BalancePool(clientId string, pool string) (Upstream, error)
+	BalanceAddr(clientId string, pool string, addr string) (Upstream, error)
+	HasPool(string) bool
+}
+
+// IAdmin balancer operations used by admin api
+type IAdmin interface {
+	UpstreamsState() []UpstreamState
+	Drain(addr string, timeout time.Duration) (int, error)
+	Undrain(addr string) error
+}
+
+// IDiscovery balancer operations used by upstream discovery providers
+type IDiscovery interface {
+	SetUpstreams([]UpstreamEntry) error
 }
@@ -0,0 +1,18 @@
+package balancer
+
+import "expvar"
+
+// balancer metrics, published via expvar (see admin api /metrics)
+var (
+	// number of circuit breaker transitions by "upstream addr:new state"
+	metricBreakerTransitions = expvar.NewMap("balancer_breaker_transitions")
+	// current circuit breaker state by upstream addr
+	metricBreakerState = expvar.NewMap("balancer_breaker_state")
+)
+
+// not thread-safe
+func (b *Balancer) publishUpstreamNotSafe(u *upstream) {
+	state := new(expvar.String)
+	state.Set(u.breaker.state.String())
+	metricBreakerState.Set(u.addr, state)
+}
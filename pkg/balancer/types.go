@@ -1,11 +1,16 @@
 package balancer
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
 type clientBalance struct {
-	// upstream addresses indexes (in balancer list of upstreams) limited by client perms
-	// we need only indexes for fast look up
-	upstrIdxs map[int]struct{}
+	// client perms reference upstreams or pools (not restricted client allowed all upstreams)
+	restricted bool
+	// upstream addresses and pools limited by client perms
+	upstrAddrs map[string]struct{}
+	pools      map[string]struct{}
 
 	// conn limit (0 no limits)
 	limit int
@@ -22,29 +27,123 @@ func (c *clientBalance) decrClient() {
 	_ = atomic.AddInt32(&c.connCntr, -1)
 }
 
-type upstrConnCntr struct {
-	// counter
-	cntr int
-	// order position in order list
-	orderIdx int
+// isAllowed reports if upstream allowed by client perms
+func (c *clientBalance) isAllowed(u *upstream) bool {
+	if !c.restricted {
+		return true
+	}
+	if _, ok := c.upstrAddrs[u.addr]; ok {
+		return true
+	}
+	for p := range u.pools {
+		if _, ok := c.pools[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+type upstream struct {
+	addr string
+	// relative weight of upstream (1 for upstreams from config)
+	weight float64
+	// pools of upstream
+	pools map[string]struct{}
+	// discovered upstream (not from config), only discovered upstreams updated by discovery
+	discovered bool
+	// discovery metadata
+	metadata map[string]string
+	// number of active connections
+	conns int
+	// slow start begin time (zero if upstream not in slow start)
+	slowStartAt time.Time
+	// circuit breaker
+	breaker breaker
+
+	// drain mode, upstream is not selected for new connections
+	draining bool
+	// force closes sessions when drain timeout expired
+	drainTimer *time.Timer
+	// active sessions (used to force close)
+	sessions map[*upstreamImpl]struct{}
+}
+
+func newUpstream(addr string) *upstream {
+	u := &upstream{
+		addr:     addr,
+		weight:   1,
+		pools:    make(map[string]struct{}),
+		sessions: make(map[*upstreamImpl]struct{}),
+	}
+	return u
+}
+
+// UpstreamState snapshot of upstream state
+type UpstreamState struct {
+	Addr            string            `json:"addr"`
+	Weight          float64           `json:"weight"`
+	EffectiveWeight float64           `json:"effectiveWeight"`
+	Conns           int               `json:"conns"`
+	SlowStart       bool              `json:"slowStart"`
+	Breaker         string            `json:"breaker"`
+	Draining        bool              `json:"draining"`
+	Discovered      bool              `json:"discovered"`
+	Pools           []string          `json:"pools,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// UpstreamEntry discovered upstream
+type UpstreamEntry struct {
+	Addr string `json:"address" yaml:"address"`
+	// default value 1
+	Weight float64 `json:"weight" yaml:"weight"`
+	// pool name, should be configured in balancer pools (optional)
+	Pool     string            `json:"pool" yaml:"pool"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
 }
 
 type Upstream interface {
 	Addr() string
-	Close()
+	// Pools return names of upstream pools
+	Pools() []string
+	// Dialed reports result of upstream dial (nil if dial succeeded)
+	Dialed(err error)
+	// Close releases upstream, sessErr is upstream side error which closed session
+	// (nil if closed normally or by client side error)
+	Close(sessErr error)
+	// Done closed when balancer force closes session (for example drain timeout)
+	Done() <-chan struct{}
 }
 
 type upstreamImpl struct {
-	balancer  *Balancer
-	clientId  string
-	upstrAddr string
-	upstrIdx  int
+	balancer *Balancer
+	clientId string
+	upstr    *upstream
+
+	// circuit breaker half-open generation if connection is trial
+	trialGen int
+	// dial succeeded time, set only by Dialed
+	dialedAt time.Time
+	// closed by balancer to force close session
+	done chan struct{}
 }
 
 func (u *upstreamImpl) Addr() string {
-	return u.upstrAddr
+	return u.upstr.addr
+}
+
+func (u *upstreamImpl) Pools() []string {
+	return u.balancer.upstreamPools(u.upstr)
+}
+
+func (u *upstreamImpl) Dialed(err error) {
+	u.balancer.dialedUpstream(u, err)
+}
+
+func (u *upstreamImpl) Close(sessErr error) {
+	u.balancer.releaseUpstream(u, sessErr)
 }
 
-func (u *upstreamImpl) Close() {
-	u.balancer.releaseUpstream(u.clientId, u.upstrIdx)
+func (u *upstreamImpl) Done() <-chan struct{} {
+	return u.done
 }
@@ -4,14 +4,21 @@ import (
 	"log"
 	"os"
 
+	"github.com/radisvaliullin/proxy/pkg/admin"
 	"github.com/radisvaliullin/proxy/pkg/auth"
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+	"github.com/radisvaliullin/proxy/pkg/discovery"
 	"github.com/radisvaliullin/proxy/pkg/proxy"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Proxy proxy.Config `yaml:"proxy"`
-	Auth  auth.Config  `yaml:"auth"`
+	Proxy    proxy.Config    `yaml:"proxy"`
+	Balancer balancer.Config `yaml:"balancer"`
+	Auth     auth.Config     `yaml:"auth"`
+	Admin    admin.Config    `yaml:"admin"`
+
+	Discovery discovery.Config `yaml:"discovery"`
 }
 
 func New() (Config, error) {
@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Upstreams file path (json or yaml by extension), empty value disables discovery
+	File string `yaml:"file"`
+	// in milliseconds, file poll interval
+	// default value 1000ms
+	Interval int `yaml:"interval"`
+	// in milliseconds, file should be unchanged during debounce before apply
+	// default value 500ms
+	Debounce int `yaml:"debounce"`
+}
+
+func (c *Config) validate() error {
+	if c.File == "" {
+		return errors.New("discovery: config: file not set")
+	}
+	if c.Interval <= 0 {
+		c.Interval = 1000
+	}
+	if c.Debounce <= 0 {
+		c.Debounce = 500
+	}
+	return nil
+}
+
+// upstreams file format
+// upstreams key is required, so empty or truncated file is not applied as empty list
+type upstreamsFile struct {
+	Upstreams *[]balancer.UpstreamEntry `json:"upstreams" yaml:"upstreams"`
+}
+
+// File discovers upstreams from file written by orchestration
+// file polled for changes, change applied when file stays unchanged during debounce
+// file with parse or validation errors (for example partially written) is skipped, previous upstreams kept
+type File struct {
+	config Config
+
+	blncer balancer.IDiscovery
+}
+
+func NewFile(conf Config, blncer balancer.IDiscovery) (*File, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	f := &File{
+		config: conf,
+		blncer: blncer,
+	}
+	return f, nil
+}
+
+// Start applies file and watches it for changes
+// return error only if initial file apply fails
+func (f *File) Start() error {
+	log.Print("discovery: file: start.")
+
+	data, err := os.ReadFile(f.config.File)
+	if err != nil {
+		log.Printf("discovery: file: read: %v", err)
+		return err
+	}
+	if err := f.apply(data); err != nil {
+		return err
+	}
+	applied := data
+
+	interval := time.Duration(f.config.Interval) * time.Millisecond
+	debounce := time.Duration(f.config.Debounce) * time.Millisecond
+
+	// last seen not applied content and time when it was seen first
+	var (
+		pending   []byte
+		pendingAt time.Time
+	)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		data, err := os.ReadFile(f.config.File)
+		if err != nil {
+			log.Printf("discovery: file: read: %v", err)
+			continue
+		}
+		if bytes.Equal(data, applied) {
+			pending = nil
+			continue
+		}
+		if pending == nil || !bytes.Equal(data, pending) {
+			pending, pendingAt = data, time.Now()
+			continue
+		}
+		if time.Since(pendingAt) < debounce {
+			continue
+		}
+		// apply once, if not valid wait next change
+		if err := f.apply(data); err != nil {
+			log.Printf("discovery: file: skip not valid file")
+		}
+		applied, pending = data, nil
+	}
+	return nil
+}
+
+func (f *File) apply(data []byte) error {
+	uf := upstreamsFile{}
+	var err error
+	switch filepath.Ext(f.config.File) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&uf)
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&uf)
+	}
+	if err != nil {
+		log.Printf("discovery: file: unmarshal: %v", err)
+		return err
+	}
+	if uf.Upstreams == nil {
+		log.Printf("discovery: file: upstreams not found")
+		return errors.New("discovery: file: upstreams not found")
+	}
+	if err := f.blncer.SetUpstreams(*uf.Upstreams); err != nil {
+		log.Printf("discovery: file: set upstreams: %v", err)
+		return err
+	}
+	log.Printf("discovery: file: applied %v upstreams", len(*uf.Upstreams))
+	return nil
+}
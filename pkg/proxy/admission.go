@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"log"
+	"math/rand"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadConfig adaptive admission
+// when goroutines number or heap size exceeds threshold proxy sheds share of new connections
+// proportional to load (load - max of goroutines and heap ratios to thresholds, admitted share is 1/load)
+// shedding stops gradually when load drops below low watermark (hysteresis)
+type OverloadConfig struct {
+	// 0 - not checked
+	MaxGoroutines int `yaml:"maxGoroutines"`
+	// in megabytes, 0 - not checked
+	MaxHeapMB int `yaml:"maxHeapMB"`
+	// in milliseconds
+	// default value 1000ms
+	CheckInterval int `yaml:"checkInterval"`
+}
+
+func (c *OverloadConfig) enabled() bool {
+	return c.MaxGoroutines > 0 || c.MaxHeapMB > 0
+}
+
+const (
+	// admit rate of all connections admitted, per mille
+	admitRateFull = 1000
+	// shedding starts when load exceeds 1, recovery starts when load below low watermark
+	overloadLowWatermark = 0.9
+	// admit rate increase per check interval during recovery, per mille
+	admitRateRecoveryStep = 100
+)
+
+// overload adaptive admission state (set by overload monitor)
+type overload struct {
+	// share of new connections admitted, per mille
+	admitRate atomic.Int64
+}
+
+func newOverload() *overload {
+	o := &overload{}
+	o.admitRate.Store(admitRateFull)
+	metricAdmitRate.Set(admitRateFull)
+	return o
+}
+
+// admit reports if new connection admitted (with probability of admit rate)
+func (o *overload) admit() bool {
+	rate := o.admitRate.Load()
+	return rate >= admitRateFull || rand.Int63n(admitRateFull) < rate
+}
+
+// nextAdmitRate return admit rate of load
+// over threshold admit rate follows load, between low watermark and threshold rate kept,
+// below low watermark rate recovers step by step
+func nextAdmitRate(rate int64, load float64) int64 {
+	switch {
+	case load > 1:
+		return int64(admitRateFull / load)
+	case load < overloadLowWatermark:
+		return min(rate+admitRateRecoveryStep, admitRateFull)
+	default:
+		return rate
+	}
+}
+
+// admission limits concurrent connections and pending tls handshakes
+// excess connections shed right after accept (before handshake)
+type admission struct {
+	// 0 - no limit
+	maxConns   int64
+	maxPending int64
+
+	conns   atomic.Int64
+	pending atomic.Int64
+
+	// adaptive admission, checked only by proxy admission (nil for listener admission)
+	overload *overload
+
+	// parent admission (proxy admission of listener admission), nil for proxy admission
+	parent *admission
+}
+
+func newAdmission(maxConns, maxPending int, overload *overload, parent *admission) *admission {
+	a := &admission{
+		maxConns:   int64(maxConns),
+		maxPending: int64(maxPending),
+		overload:   overload,
+		parent:     parent,
+	}
+	return a
+}
+
+// admit reports if accepted connection can be handled
+// admitted connection counted as connection with pending handshake
+// (handshakeDone and release should be called)
+func (a *admission) admit() bool {
+	if a.overload != nil && !a.overload.admit() {
+		metricConnsShed.Add(shedReasonOverload, 1)
+		return false
+	}
+	if n := a.conns.Add(1); a.maxConns > 0 && n > a.maxConns {
+		a.conns.Add(-1)
+		metricConnsShed.Add(shedReasonMaxConns, 1)
+		return false
+	}
+	if n := a.pending.Add(1); a.maxPending > 0 && n > a.maxPending {
+		a.pending.Add(-1)
+		a.conns.Add(-1)
+		metricConnsShed.Add(shedReasonMaxPending, 1)
+		return false
+	}
+	if a.parent != nil {
+		if !a.parent.admit() {
+			a.pending.Add(-1)
+			a.conns.Add(-1)
+			return false
+		}
+		// metrics counted by parent
+		return true
+	}
+	metricConns.Add(1)
+	metricPendingHandshakes.Add(1)
+	return true
+}
+
+func (a *admission) handshakeDone() {
+	a.pending.Add(-1)
+	if a.parent != nil {
+		a.parent.handshakeDone()
+		return
+	}
+	metricPendingHandshakes.Add(-1)
+}
+
+func (a *admission) release() {
+	a.conns.Add(-1)
+	if a.parent != nil {
+		a.parent.release()
+		return
+	}
+	metricConns.Add(-1)
+}
+
+// overloadMonitor checks goroutines number and heap size and sets admit rate
+func overloadMonitor(conf OverloadConfig, ol *overload) {
+	interval := time.Duration(conf.CheckInterval) * time.Millisecond
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var load float64
+		if conf.MaxGoroutines > 0 {
+			load = float64(runtime.NumGoroutine()) / float64(conf.MaxGoroutines)
+		}
+		if conf.MaxHeapMB > 0 {
+			metrics.Read(sample)
+			if sample[0].Value.Kind() == metrics.KindUint64 {
+				load = max(load, float64(sample[0].Value.Uint64())/float64(uint64(conf.MaxHeapMB)<<20))
+			}
+		}
+		prev := ol.admitRate.Load()
+		rate := nextAdmitRate(prev, load)
+		if rate == prev {
+			continue
+		}
+		ol.admitRate.Store(rate)
+		metricAdmitRate.Set(rate)
+		if over := rate < admitRateFull; over != (prev < admitRateFull) {
+			log.Printf("proxy: overload: overloaded %v, load %.2f", over, load)
+			if over {
+				metricOverloaded.Set(1)
+			} else {
+				metricOverloaded.Set(0)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import "testing"
+
+func TestNextAdmitRate(t *testing.T) {
+	tests := []struct {
+		rate int64
+		load float64
+		want int64
+	}{
+		// not overloaded
+		{rate: admitRateFull, load: 0.5, want: admitRateFull},
+		{rate: admitRateFull, load: 1, want: admitRateFull},
+		// admitted share follows load over threshold
+		{rate: admitRateFull, load: 1.25, want: 800},
+		{rate: 800, load: 2, want: 500},
+		{rate: 500, load: 1.25, want: 800},
+		// hysteresis, rate kept between low watermark and threshold
+		{rate: 500, load: 0.95, want: 500},
+		// recovery step by step below low watermark
+		{rate: 500, load: 0.5, want: 600},
+		{rate: 950, load: 0.5, want: admitRateFull},
+	}
+	for _, tt := range tests {
+		if got := nextAdmitRate(tt.rate, tt.load); got != tt.want {
+			t.Errorf("nextAdmitRate(%v, %v) = %v, want %v", tt.rate, tt.load, got, tt.want)
+		}
+	}
+}
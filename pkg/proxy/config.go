@@ -1,5 +1,10 @@
 package proxy
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Config struct {
 	// mTLS
 	// Client CA Cert file path
@@ -9,20 +14,67 @@ type Config struct {
 	SrvKeyPath  string `yaml:"serverKeyPath"`
 
 	// Proxy Addr (ip/port)
+	// used if listeners not set
 	Addr string `yaml:"addr"`
+	// Proxy listeners (optional)
+	// if not set proxy listens on Addr with mTLS config above
+	Listeners []ListenerConfig `yaml:"listeners"`
 	// Upstream Addrs (list of ip:port)
 	UpstreamAddrs []string `yaml:"upstreamAddrs"`
+	// Upstream dial settings by upstream addr or pool (optional)
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
 
-	// in seconds
+	// in seconds, tls handshake timeout
+	// (can not be overridden per client, client identity known only after handshake)
+	// default value 10s
+	HandshakeTimeout int `yaml:"handshakeTimeout"`
+	// in seconds, idle timeout of session (heartbeat)
+	// can be overridden per client by auth perms
 	// default value 10s
 	HeartbeatTimeout int `yaml:"heartbeatTimeout"`
+	// idle mode, "direction" - session closed if any direction idle
+	// "combined" - session closed if both directions idle
+	// default value "direction"
+	IdleMode string `yaml:"idleMode"`
+	// in seconds, max session duration
+	// can be overridden per client by auth perms
+	// default value 0 (no limit)
+	MaxSessionDuration int `yaml:"maxSessionDuration"`
 	// max number of bytes used for one read/write forward
 	// value can be based on size of packet used in client/server protocol
+	// (not used by zero-copy tcp to tcp forward)
 	// default value 2048
 	ForwardBuffSize int `yaml:"forwardBuffSize"`
+
+	// max concurrent connections of all listeners, excess connections closed before tls handshake
+	// default value 0 (no limit)
+	MaxConns int `yaml:"maxConns"`
+	// max concurrent pending tls handshakes of all listeners, excess connections closed before tls handshake
+	// default value 0 (no limit)
+	MaxPendingHandshakes int `yaml:"maxPendingHandshakes"`
+	// adaptive admission (optional)
+	Overload OverloadConfig `yaml:"overload"`
 }
 
+const (
+	IdleModeDirection = "direction"
+	IdleModeCombined  = "combined"
+)
+
 func (c *Config) validate() error {
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = 10
+	}
+	switch c.IdleMode {
+	case "":
+		c.IdleMode = IdleModeDirection
+	case IdleModeDirection, IdleModeCombined:
+	default:
+		return fmt.Errorf("proxy: config: wrong idle mode %q", c.IdleMode)
+	}
+	if c.MaxSessionDuration < 0 {
+		return errors.New("proxy: config: wrong max session duration")
+	}
 	if c.HeartbeatTimeout <= 0 {
 		//
 		c.HeartbeatTimeout = 10
@@ -30,5 +82,40 @@ func (c *Config) validate() error {
 	if c.ForwardBuffSize <= 0 {
 		c.ForwardBuffSize = 2048
 	}
+	if c.MaxConns < 0 || c.MaxPendingHandshakes < 0 {
+		return errors.New("proxy: config: wrong connection limits")
+	}
+	if c.Overload.MaxGoroutines < 0 || c.Overload.MaxHeapMB < 0 {
+		return errors.New("proxy: config: wrong overload thresholds")
+	}
+	if c.Overload.CheckInterval <= 0 {
+		c.Overload.CheckInterval = 1000
+	}
+	if len(c.Listeners) == 0 {
+		c.Listeners = []ListenerConfig{{Addr: c.Addr}}
+	}
+	names := make(map[string]struct{}, len(c.Listeners))
+	for i := range c.Listeners {
+		if err := c.Listeners[i].validate(c); err != nil {
+			return err
+		}
+		if _, ok := names[c.Listeners[i].Name]; ok {
+			return fmt.Errorf("proxy: config: duplicated listener name %q", c.Listeners[i].Name)
+		}
+		names[c.Listeners[i].Name] = struct{}{}
+	}
+	upstrs := make(map[string]struct{}, len(c.UpstreamAddrs))
+	for _, u := range c.UpstreamAddrs {
+		upstrs[u] = struct{}{}
+	}
+	for i := range c.Upstreams {
+		if err := c.Upstreams[i].validate(); err != nil {
+			return err
+		}
+		// typo in addr silently disables upstream settings
+		if _, ok := upstrs[c.Upstreams[i].Addr]; c.Upstreams[i].Addr != "" && !ok {
+			return fmt.Errorf("proxy: config: upstream settings reference unknown upstream addr %q", c.Upstreams[i].Addr)
+		}
+	}
 	return nil
 }
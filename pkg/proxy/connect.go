@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+// connect: mTLS, then HTTP CONNECT request names upstream addr (should match configured upstream addr)
+// reply 200 when upstream connected, 400 if request malformed, 403 if upstream not allowed for client,
+// 429 if client connections limit exceeded, 502 if upstream not available
+func (p *Proxy) identifyConnect(conn net.Conn, l *listener) (*session, error) {
+	sess, err := p.identifyMTLS(conn, l)
+	if err != nil {
+		return nil, err
+	}
+	if err := readConnectRequest(sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// readConnectRequest reads client CONNECT request, sets session target addr
+func readConnectRequest(sess *session) error {
+	br := bufio.NewReader(sess.conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		log.Printf("proxy: handler: client %v: read connect request: %v", sess.clientId, err)
+		// client gone or handshake timeout, no reply
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = writeConnectReply(sess.conn, http.StatusBadRequest)
+		}
+		return err
+	}
+	if req.Method != http.MethodConnect {
+		_ = writeConnectReply(sess.conn, http.StatusMethodNotAllowed)
+		return fmt.Errorf("http method %v not allowed", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		_ = writeConnectReply(sess.conn, http.StatusBadRequest)
+		return err
+	}
+	sess.target = req.Host
+	// tunnel bytes sent by client right after request
+	if n := br.Buffered(); n > 0 {
+		sess.prefix, _ = br.Peek(n)
+	}
+	sess.reply = func(err error) error {
+		return writeConnectReply(sess.conn, connectStatus(err))
+	}
+	return nil
+}
+
+// connectStatus return CONNECT reply status of upstream connect result
+func connectStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, balancer.ErrUpstreamNotAllowed),
+		errors.Is(err, balancer.ErrClientNotConfig),
+		errors.Is(err, ErrClientNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, balancer.ErrClientExceedLimti):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeConnectReply(w io.Writer, status int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+	return err
+}
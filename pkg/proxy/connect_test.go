@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+// bufConn client conn of sent bytes, replies written to buffer
+// client bytes read at once, so bytes sent after handshake are buffered by parser
+type bufConn struct {
+	net.Conn
+	r *strings.Reader
+	w bytes.Buffer
+}
+
+func newBufConn(sent string) *bufConn {
+	return &bufConn{r: strings.NewReader(sent)}
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func TestReadConnectRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		sent   string
+		target string
+		prefix string
+		// reply written on error (empty if no reply)
+		reply string
+		ok    bool
+	}{
+		{name: "connect", sent: "CONNECT u1:80 HTTP/1.1\r\nHost: u1:80\r\n\r\n", target: "u1:80", ok: true},
+		{name: "connect with data", sent: "CONNECT u1:80 HTTP/1.1\r\nHost: u1:80\r\n\r\nhello", target: "u1:80", prefix: "hello", ok: true},
+		{name: "method", sent: "GET / HTTP/1.1\r\nHost: u1:80\r\n\r\n", reply: "HTTP/1.1 405 Method Not Allowed\r\n\r\n"},
+		{name: "no port", sent: "CONNECT u1 HTTP/1.1\r\nHost: u1\r\n\r\n", reply: "HTTP/1.1 400 Bad Request\r\n\r\n"},
+		{name: "malformed", sent: "CONNECT\r\n\r\n", reply: "HTTP/1.1 400 Bad Request\r\n\r\n"},
+		// client gone, no reply
+		{name: "truncated", sent: "CONNECT u1:80 HTTP/1.1\r\nHost: u1:80\r\n"},
+		{name: "empty", sent: ""},
+	}
+	for _, tt := range tests {
+		conn := newBufConn(tt.sent)
+		sess := &session{conn: conn, clientId: "c"}
+		err := readConnectRequest(sess)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%v: error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if sess.target != tt.target || string(sess.prefix) != tt.prefix {
+			t.Fatalf("%v: target %q prefix %q, want %q %q", tt.name, sess.target, sess.prefix, tt.target, tt.prefix)
+		}
+		if conn.w.String() != tt.reply {
+			t.Fatalf("%v: reply %q, want %q", tt.name, conn.w.String(), tt.reply)
+		}
+		if tt.ok {
+			if err := sess.reply(nil); err != nil {
+				t.Fatal(err)
+			}
+			if want := "HTTP/1.1 200 OK\r\n\r\n"; conn.w.String() != want {
+				t.Fatalf("%v: reply %q, want %q", tt.name, conn.w.String(), want)
+			}
+		}
+	}
+}
+
+func TestConnectStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: nil, want: http.StatusOK},
+		{err: balancer.ErrUpstreamNotAllowed, want: http.StatusForbidden},
+		{err: balancer.ErrClientNotConfig, want: http.StatusForbidden},
+		{err: ErrClientNotAllowed, want: http.StatusForbidden},
+		{err: balancer.ErrClientExceedLimti, want: http.StatusTooManyRequests},
+		{err: balancer.ErrCanNotGetUpstream, want: http.StatusBadGateway},
+		{err: syscall.ECONNREFUSED, want: http.StatusBadGateway},
+		{err: errors.New("dial timeout"), want: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if got := connectStatus(tt.err); got != tt.want {
+			t.Errorf("connectStatus(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
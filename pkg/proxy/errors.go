@@ -4,16 +4,32 @@ import "fmt"
 
 const (
 	ErrKindForwardHeartBeat = iota
+	ErrKindSessionForceClosed
+	ErrKindHandshakeTimeout
+	ErrKindSessionMaxDuration
+	ErrKindClientNotAllowed
 )
 
 var (
-	ErrForwardHeartBeat = ProxyError{Kind: ErrKindForwardHeartBeat}
+	ErrForwardHeartBeat   = ProxyError{Kind: ErrKindForwardHeartBeat}
+	ErrSessionForceClosed = ProxyError{Kind: ErrKindSessionForceClosed}
+	ErrHandshakeTimeout   = ProxyError{Kind: ErrKindHandshakeTimeout}
+	ErrSessionMaxDuration = ProxyError{Kind: ErrKindSessionMaxDuration}
+	ErrClientNotAllowed   = ProxyError{Kind: ErrKindClientNotAllowed}
 )
 
 func getErrorMessage(kind int) string {
 	switch kind {
 	case ErrKindForwardHeartBeat:
 		return "forward heartbeat timeout"
+	case ErrKindSessionForceClosed:
+		return "session force closed by balancer"
+	case ErrKindHandshakeTimeout:
+		return "tls handshake timeout"
+	case ErrKindSessionMaxDuration:
+		return "session max duration exceeded"
+	case ErrKindClientNotAllowed:
+		return "client not allowed"
 	default:
 		return "unknown"
 	}
@@ -1,54 +1,155 @@
 package proxy
 
 import (
-	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// idleTracker tracks last read/write activity of forward direction
+// idle detection based on src conn read deadline, no extra goroutines and timers per session
+type idleTracker struct {
+	// idle timeout
+	idle time.Duration
+	// last activity time (unix nano)
+	last atomic.Int64
+}
+
+func newIdleTracker(idle time.Duration) *idleTracker {
+	t := &idleTracker{idle: idle}
+	t.touch(time.Now())
+	return t
+}
+
+func (t *idleTracker) touch(now time.Time) {
+	t.last.Store(now.UnixNano())
+}
+
+// deadline return time when direction becomes idle
+func (t *idleTracker) deadline() time.Time {
+	return time.Unix(0, t.last.Load()).Add(t.idle)
+}
+
 // forwards conn stream from one source to another
-// sessCancel - cancel session (unlock connections, call close)
-// hbDur - heartbeat duration, define heartbeat time interval
-// if read/write operation not active longer than heartbeat interval function trigger conn session close
-func streamForwarderWithHeartbeat(sessCancel context.CancelFunc, in, out net.Conn, hbDur time.Duration, buffSize int) error {
-	// read/write err channel
-	rwErrChan := make(chan error)
-	// use reader with tick to notify about read/write activity
-	inWithTicker, rTicker := newReaderWithTicker(in)
-
-	// read/write goroutine
-	go func() {
-		buff := make([]byte, buffSize)
-		if _, err := io.CopyBuffer(out, inWithTicker, buff); err != nil {
-			rwErrChan <- err
+// returns nil when in reached EOF
+// tracker - define idle timeout
+// if read/write operation not active longer than idle timeout function returns ErrForwardHeartBeat
+// (copy call with activity extends deadline, so idle detected in range of one to two idle timeouts)
+// read and write errors returned as *connError of failed conn
+// (splice does not report which conn failed, so splice error is error of both conns)
+func streamForwarder(in, out net.Conn, tracker *idleTracker, buffPool *sync.Pool) error {
+	// underlying conns are not wrapped, so tcp/unix to tcp copy uses splice (zero-copy) path of *net.TCPConn
+	// reached only without tls termination and origination: plain, passthrough and socks5plain listeners
+	// to plain tcp upstreams (unix listener conn only in client to upstream direction)
+	// other conns (tls of mtls, connect, socks5 listeners or upstream tls) copied with pooled buffer
+	cp := func(dst, src net.Conn) (int64, error) {
+		buff := buffPool.Get().(*[]byte)
+		defer buffPool.Put(buff)
+		// hide ReaderFrom/WriterTo, they ignore buffer
+		w := &writerOnly{Writer: dst}
+		n, err := io.CopyBuffer(w, readerOnly{src}, *buff)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			// copy returns write error (or short write) if write failed, otherwise read error
+			failed := src
+			if w.failed {
+				failed = dst
+			}
+			err = &connError{conn: failed, err: err}
 		}
-		// close signals that goroutine closed
-		close(rwErrChan)
-	}()
-
-	// track aliveness of read/write
-	err := func() error {
-		hbTm := time.NewTimer(hbDur)
-		defer hbTm.Stop()
-		for {
-			select {
-			case <-rTicker:
-				if !hbTm.Stop() {
-					<-hbTm.C
-				}
-				hbTm.Reset(hbDur)
-			case <-hbTm.C:
-				// unlock connections
-				sessCancel()
-				return ErrForwardHeartBeat
-			case err := <-rwErrChan:
-				return err
+		return n, err
+	}
+	if isSpliceable(out, in) {
+		cp = func(dst, src net.Conn) (int64, error) {
+			n, err := dst.(*net.TCPConn).ReadFrom(src)
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				err = &connError{conn: src, peer: dst, err: err}
 			}
+			return n, err
+		}
+	}
+	for {
+		deadline := tracker.deadline()
+		if err := in.SetReadDeadline(deadline); err != nil {
+			return &connError{conn: in, err: err}
+		}
+		n, err := cp(out, in)
+		now := time.Now()
+		if n > 0 {
+			tracker.touch(now)
+		}
+		if err == nil {
+			return nil
 		}
-	}()
-	// read r/w error if not yet read
-	// blocked until r/w goroutine end
-	<-rwErrChan
-	return err
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if n == 0 && !now.Before(tracker.deadline()) {
+			return ErrForwardHeartBeat
+		}
+	}
+}
+
+// isSpliceable reports if *net.TCPConn ReadFrom can use splice(2) for src
+func isSpliceable(dst, src net.Conn) bool {
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	default:
+		return false
+	}
+}
+
+// hides io.ReaderFrom of writer
+type writerOnly struct {
+	io.Writer
+	// write returned error or short write
+	failed bool
+}
+
+func (w *writerOnly) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if err != nil || n < len(b) {
+		w.failed = true
+	}
+	return n, err
+}
+
+// hides io.WriterTo of reader
+type readerOnly struct {
+	io.Reader
+}
+
+// connError forward error of conn (read from source or write to destination)
+type connError struct {
+	conn net.Conn
+	// other conn of spliced copy, error may be of either conn (nil if failed conn known)
+	peer net.Conn
+	err  error
+}
+
+func (e *connError) Error() string { return e.err.Error() }
+
+func (e *connError) Unwrap() error { return e.err }
+
+// isConnError reports if err is forward error of conn
+func isConnError(err error, conn net.Conn) bool {
+	var ce *connError
+	return errors.As(err, &ce) && (ce.conn == conn || ce.peer == conn)
+}
+
+// newBuffPool pool of forward buffers
+func newBuffPool(buffSize int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			b := make([]byte, buffSize)
+			return &b
+		},
+	}
 }
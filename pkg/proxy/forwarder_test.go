@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpPair return connected loopback tcp conns
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		client.Close()
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// hides *net.TCPConn, forwarder uses pooled buffer copy (as for tls conns)
+type wrappedConn struct {
+	net.Conn
+}
+
+// benchmarkForward forwards b.N chunks src -> in -> (forwarder) -> out -> dst
+func benchmarkForward(b *testing.B, splice bool, chunkSize int) {
+	src, in := tcpPair(b)
+	out, dst := tcpPair(b)
+	fin, fout := in, out
+	if !splice {
+		fin, fout = wrappedConn{in}, wrappedConn{out}
+	}
+	if isSpliceable(fout, fin) != splice {
+		b.Fatalf("spliceable %v, want %v", !splice, splice)
+	}
+
+	buffPool := newBuffPool(2048)
+	forwarded := make(chan error, 1)
+	go func() {
+		err := streamForwarder(fin, fout, newIdleTracker(time.Minute), buffPool)
+		closeWriteWithLog(out)
+		forwarded <- err
+	}()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, dst)
+		received <- n
+	}()
+
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(int64(chunkSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := src.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	closeWriteWithLog(src)
+	if err := <-forwarded; err != nil {
+		b.Fatal(err)
+	}
+	n := <-received
+	b.StopTimer()
+	if want := int64(b.N) * int64(chunkSize); n != want {
+		b.Fatalf("received %v bytes, want %v", n, want)
+	}
+}
+
+// splice path, reached by plain, passthrough and socks5plain listeners to plain tcp upstreams
+func BenchmarkForwardSplice(b *testing.B) {
+	benchmarkForward(b, true, 32*1024)
+}
+
+// pooled buffer path, tls terminated or originated sessions (mtls, connect, socks5 listeners)
+func BenchmarkForwardBuffer(b *testing.B) {
+	benchmarkForward(b, false, 32*1024)
+}
+
+func BenchmarkForwardSpliceSmall(b *testing.B) {
+	benchmarkForward(b, true, 512)
+}
+
+func BenchmarkForwardBufferSmall(b *testing.B) {
+	benchmarkForward(b, false, 512)
+}
+
+// baseline forwarder (before read deadline idle detection), copied for comparison
+// copy goroutine and heartbeat timer goroutine per direction, buffer allocated per direction,
+// reader notifies heartbeat of each read by channel send
+
+// forwards conn stream from one source to another
+// sessCancel - cancel session (unlock connections, call close)
+// hbDur - heartbeat duration, define heartbeat time interval
+// if read/write operation not active longer than heartbeat interval function trigger conn session close
+func baselineStreamForwarderWithHeartbeat(sessCancel context.CancelFunc, in, out net.Conn, hbDur time.Duration, buffSize int) error {
+	// read/write err channel
+	rwErrChan := make(chan error)
+	// use reader with tick to notify about read/write activity
+	inWithTicker, rTicker := newBaselineReaderWithTicker(in)
+
+	// read/write goroutine
+	go func() {
+		buff := make([]byte, buffSize)
+		if _, err := io.CopyBuffer(out, inWithTicker, buff); err != nil {
+			rwErrChan <- err
+		}
+		// close signals that goroutine closed
+		close(rwErrChan)
+	}()
+
+	// track aliveness of read/write
+	err := func() error {
+		hbTm := time.NewTimer(hbDur)
+		defer hbTm.Stop()
+		for {
+			select {
+			case <-rTicker:
+				if !hbTm.Stop() {
+					<-hbTm.C
+				}
+				hbTm.Reset(hbDur)
+			case <-hbTm.C:
+				// unlock connections
+				sessCancel()
+				return ErrForwardHeartBeat
+			case err := <-rwErrChan:
+				return err
+			}
+		}
+	}()
+	// read r/w error if not yet read
+	// blocked until r/w goroutine end
+	<-rwErrChan
+	return err
+}
+
+// notify each time when next bytes read done
+type baselineReaderWithTicker struct {
+	reader io.Reader
+	tick   chan struct{}
+}
+
+// return reader and ticker channel
+// ticker will update after each read bytes done
+func newBaselineReaderWithTicker(r io.Reader) (nr io.Reader, t <-chan struct{}) {
+	ticker := make(chan struct{}, 1)
+	rwt := &baselineReaderWithTicker{
+		reader: r,
+		tick:   ticker,
+	}
+	return rwt, ticker
+}
+
+func (r *baselineReaderWithTicker) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	// non blocking send
+	select {
+	case r.tick <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+// benchmarkIdleSessions opens idle sessions (two forward directions each)
+// and reports forward goroutines, heap and stack per session
+func benchmarkIdleSessions(b *testing.B, forward func(in, out net.Conn, idle time.Duration, buffPool *sync.Pool) error) {
+	const sessions = 200
+	buffPool := newBuffPool(2048)
+	var goroutines, heap, stack float64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		type pair struct{ client, upstream net.Conn }
+		pairs := make([]pair, sessions)
+		for j := range pairs {
+			_, client := tcpPair(b)
+			upstream, _ := tcpPair(b)
+			pairs[j] = pair{client: client, upstream: upstream}
+		}
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		g := runtime.NumGoroutine()
+		b.StartTimer()
+
+		wg := sync.WaitGroup{}
+		for _, pr := range pairs {
+			wg.Add(2)
+			go func(pr pair) {
+				defer wg.Done()
+				_ = forward(pr.client, pr.upstream, time.Minute, buffPool)
+			}(pr)
+			go func(pr pair) {
+				defer wg.Done()
+				_ = forward(pr.upstream, pr.client, time.Minute, buffPool)
+			}(pr)
+		}
+		// forwarders blocked in read
+		time.Sleep(100 * time.Millisecond)
+
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		goroutines = float64(runtime.NumGoroutine()-g) / sessions
+		heap = float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / sessions
+		stack = float64(int64(after.StackInuse)-int64(before.StackInuse)) / sessions
+		for _, pr := range pairs {
+			pr.client.Close()
+			pr.upstream.Close()
+		}
+		wg.Wait()
+		b.StartTimer()
+	}
+	b.ReportMetric(goroutines, "goroutines/session")
+	b.ReportMetric(heap, "heapB/session")
+	b.ReportMetric(stack, "stackB/session")
+}
+
+// idle detection by read deadlines, one goroutine per direction, no timers
+func BenchmarkIdleSessions(b *testing.B) {
+	benchmarkIdleSessions(b, func(in, out net.Conn, idle time.Duration, buffPool *sync.Pool) error {
+		return streamForwarder(in, out, newIdleTracker(idle), buffPool)
+	})
+}
+
+// before: baseline forwarder, heartbeat goroutine, timer and buffer per direction
+func BenchmarkIdleSessionsBaseline(b *testing.B) {
+	benchmarkIdleSessions(b, func(in, out net.Conn, idle time.Duration, _ *sync.Pool) error {
+		// session cancel closes conns
+		sessCancel := func() {
+			in.Close()
+			out.Close()
+		}
+		return baselineStreamForwarderWithHeartbeat(sessCancel, in, out, idle, 2048)
+	})
+}
+
+// idle direction closed in range of one to two idle timeouts since last activity
+func TestForwardIdleTimeout(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	// scheduling slack (loaded machine, race detector), upper bound only separates
+	// detected idle from idle not detected at all
+	const slack = 5 * idle
+	for _, activeFor := range []time.Duration{0, idle / 2, 3 * idle / 2} {
+		src, in := tcpPair(t)
+		out, _ := tcpPair(t)
+
+		start := time.Now()
+		lastActivity := make(chan time.Time, 1)
+		go func() {
+			last := start
+			for time.Since(start) < activeFor {
+				if _, err := src.Write([]byte("ping")); err != nil {
+					break
+				}
+				last = time.Now()
+				time.Sleep(idle / 4)
+			}
+			lastActivity <- last
+		}()
+		err := streamForwarder(in, out, newIdleTracker(idle), newBuffPool(2048))
+		done := time.Now()
+		if !errors.Is(err, ErrForwardHeartBeat) {
+			t.Fatalf("active for %v: error %v, want %v", activeFor, err, ErrForwardHeartBeat)
+		}
+		elapsed := done.Sub(<-lastActivity)
+		if elapsed < idle || elapsed > 2*idle+slack {
+			t.Fatalf("active for %v: closed %v after last activity, want in [%v, %v]", activeFor, elapsed, idle, 2*idle+slack)
+		}
+	}
+}
+
+// resetConn closes conn with RST (peer read returns connection reset)
+func resetConn(tb testing.TB, conn net.Conn) {
+	tb.Helper()
+	if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+		tb.Fatal(err)
+	}
+	conn.Close()
+}
+
+// forward error attributed to failed conn, splice error attributed to both conns
+func TestForwardConnError(t *testing.T) {
+	for _, splice := range []bool{true, false} {
+		wrap := func(c net.Conn) net.Conn {
+			if splice {
+				return c
+			}
+			return wrappedConn{c}
+		}
+
+		// upstream reset, upstream -> client direction fails reading upstream
+		upstreamPeer, upstream := tcpPair(t)
+		client, _ := tcpPair(t)
+		fupstream, fclient := wrap(upstream), wrap(client)
+		resetConn(t, upstreamPeer)
+		err := streamForwarder(fupstream, fclient, newIdleTracker(time.Minute), newBuffPool(2048))
+		if err == nil || !isConnError(err, fupstream) {
+			t.Fatalf("splice %v: upstream reset: error %v not upstream error", splice, err)
+		}
+		if !splice && isConnError(err, fclient) {
+			t.Fatalf("splice %v: upstream reset: error %v is client error", splice, err)
+		}
+
+		// upstream reset, client -> upstream direction fails writing upstream
+		upstreamPeer, upstream = tcpPair(t)
+		clientPeer, client := tcpPair(t)
+		fupstream, fclient = wrap(upstream), wrap(client)
+		resetConn(t, upstreamPeer)
+		go func() {
+			chunk := make([]byte, 32*1024)
+			for {
+				if _, err := clientPeer.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+		err = streamForwarder(fclient, fupstream, newIdleTracker(time.Minute), newBuffPool(2048))
+		if err == nil || !isConnError(err, fupstream) {
+			t.Fatalf("splice %v: upstream reset on write: error %v not upstream error", splice, err)
+		}
+		if !splice && isConnError(err, fclient) {
+			t.Fatalf("splice %v: upstream reset on write: error %v is client error", splice, err)
+		}
+		clientPeer.Close()
+
+		// client reset, client -> upstream direction fails reading client
+		clientPeer, client = tcpPair(t)
+		_, upstream = tcpPair(t)
+		fupstream, fclient = wrap(upstream), wrap(client)
+		resetConn(t, clientPeer)
+		err = streamForwarder(fclient, fupstream, newIdleTracker(time.Minute), newBuffPool(2048))
+		if err == nil || !isConnError(err, fclient) {
+			t.Fatalf("splice %v: client reset: error %v not client error", splice, err)
+		}
+		// splice does not report failed conn
+		if isConnError(err, fupstream) != splice {
+			t.Fatalf("splice %v: client reset: error %v upstream error %v", splice, err, !splice)
+		}
+	}
+}
+
+// closed conn fails setting read deadline
+func TestForwardDeadlineError(t *testing.T) {
+	_, in := tcpPair(t)
+	out, _ := tcpPair(t)
+	in.Close()
+	err := streamForwarder(in, out, newIdleTracker(time.Minute), newBuffPool(2048))
+	if !isConnError(err, in) || isConnError(err, out) {
+		t.Fatalf("error %v not error of in conn", err)
+	}
+}
@@ -1,20 +1,109 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-func connCloseWithLog(conn net.Conn) {
+// unix socket addr scheme (unix:///run/app.sock)
+const unixScheme = "unix://"
+
+func connCloseWithLog(conn io.Closer) {
 	if err := conn.Close(); err != nil {
 		log.Printf("proxy: handler: conn close err: %v", err)
 	}
 }
 
+// conn supports half-close (*net.TCPConn, *net.UnixConn, *tls.Conn)
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWriteWithLog half-closes write side of conn if conn supports half-close
+func closeWriteWithLog(conn net.Conn) {
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		return
+	}
+	if err := cw.CloseWrite(); err != nil {
+		log.Printf("proxy: handler: conn close write err: %v", err)
+	}
+}
+
 func DefaultDialer() *net.Dialer {
 	d := &net.Dialer{
 		Timeout: time.Second * 15,
 	}
 	return d
 }
+
+// splitNetworkAddr return network and address of addr
+// "unix:///path" addr is unix socket path, other addrs use default network
+func splitNetworkAddr(addr string, defaultNetwork string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return defaultNetwork, addr
+}
+
+// removeStaleUnixSocket removes unix socket file left by previous process
+// file removed only if it is a socket and nobody accepts connections on it
+func removeStaleUnixSocket(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("proxy: unix socket path %v exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		connCloseWithLog(conn)
+		return fmt.Errorf("proxy: unix socket %v in use", path)
+	}
+	log.Printf("proxy: remove stale unix socket %v", path)
+	return os.Remove(path)
+}
+
+// local unix datagram socket paths sequence
+var unixgramSeq atomic.Uint64
+
+// unixgramConn unix datagram conn with own bound local socket file (removed on close)
+type unixgramConn struct {
+	*net.UnixConn
+	localPath string
+}
+
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	if rerr := os.Remove(c.localPath); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+		log.Printf("proxy: remove unix socket %v: %v", c.localPath, rerr)
+	}
+	return err
+}
+
+// dialUnixgram dials unix datagram socket path from bound local socket
+// unbound datagram socket has no addr, so peer can not reply
+func dialUnixgram(path string) (net.Conn, error) {
+	localPath := filepath.Join(os.TempDir(), fmt.Sprintf("proxy-%d-%d.sock", os.Getpid(), unixgramSeq.Add(1)))
+	laddr := &net.UnixAddr{Name: localPath, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		// socket file may be bound before connect failed
+		_ = os.Remove(localPath)
+		return nil, err
+	}
+	return &unixgramConn{UnixConn: conn, localPath: localPath}, nil
+}
@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+)
+
+// listener modes
+const (
+	// tls terminated by proxy, client authenticated by client certificate
+	ListenerModeMTLS = "mtls"
+	// tls not terminated, route by server name peeked from client hello
+	ListenerModePassthrough = "passthrough"
+	// plain tcp, client identified by source addr (auth client source cidrs)
+	ListenerModePlain = "plain"
+	// udp datagrams, flows tracked by source addr, client identified as in plain mode
+	ListenerModeUDP = "udp"
+	// mtls, then HTTP CONNECT request selects upstream addr
+	ListenerModeConnect = "connect"
+	// mtls, then SOCKS5 request selects upstream addr or pool
+	ListenerModeSOCKS5 = "socks5"
+	// plain tcp SOCKS5, client authenticated by username (client id) and password
+	ListenerModeSOCKS5Plain = "socks5plain"
+)
+
+// ListenerConfig proxy listener
+// empty mTLS fields use proxy config values
+type ListenerConfig struct {
+	// listener name used in logs
+	// default value addr
+	Name string `yaml:"name"`
+	// tcp, tcp4, tcp6 or unix (udp, udp4 or udp6 in udp mode)
+	// default value tcp (udp in udp mode)
+	Network string `yaml:"network"`
+	// ip/port or unix socket path (unix network or unix:///path addr)
+	Addr string `yaml:"addr"`
+	// mtls, passthrough, plain, udp, connect, socks5 or socks5plain
+	// default value mtls
+	Mode string `yaml:"mode"`
+
+	// mTLS
+	// Client CA Cert file path
+	ClnCACertPath string `yaml:"clientCACertPath"`
+	// Server Cert and Key file path
+	SrvCertPath string `yaml:"serverCertPath"`
+	SrvKeyPath  string `yaml:"serverKeyPath"`
+
+	// client ids allowed on listener (empty - all clients)
+	AllowedClients []string `yaml:"allowedClients"`
+	// upstream pool of listener (empty - all client upstreams)
+	Pool string `yaml:"pool"`
+	// client id of listener sessions, required by passthrough mode (client certificate not visible)
+	// in plain and udp modes used for sources not matched by auth client source cidrs (empty - rejected)
+	// should be configured in auth, client perms and limits applied
+	ClientId string `yaml:"clientId"`
+	// mtls mode, client sends preamble line after tls handshake to select pool or upstream addr
+	// ("pool:<name>", "upstream:<addr>" or "any"), proxy replies "OK" or "ERR <reason>"
+	// selection validated by client perms and route pool
+	Preamble bool `yaml:"preamble"`
+	// ALPN protocols advertised by listener (route protocols added)
+	ALPN []string `yaml:"alpn"`
+	// routes by tls server name (SNI) and ALPN protocol, listener config above is default route
+	Routes []RouteConfig `yaml:"routes"`
+
+	// PROXY protocol header accepted from trusted load balancers (optional)
+	ProxyProtocol ListenerProxyProtocolConfig `yaml:"proxyProtocol"`
+
+	// listener connection limits, proxy limits applied too
+	// default value 0 (no limit)
+	MaxConns             int `yaml:"maxConns"`
+	MaxPendingHandshakes int `yaml:"maxPendingHandshakes"`
+}
+
+// ListenerProxyProtocolConfig PROXY protocol v1/v2 header read before tls handshake
+type ListenerProxyProtocolConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// source CIDRs of trusted load balancers, header required from them
+	// connections of other sources served as direct client connections
+	// unix socket sources are trusted (access controlled by socket file permissions)
+	TrustedCIDRs []string `yaml:"trustedCIDRs"`
+}
+
+func (c *ListenerConfig) validate(pc *Config) error {
+	if c.Addr == "" {
+		return fmt.Errorf("proxy: config: listener %q addr not set", c.Name)
+	}
+	if c.Name == "" {
+		c.Name = c.Addr
+	}
+	// unix:///path addr is unix socket listener
+	if network, path := splitNetworkAddr(c.Addr, c.Network); network == "unix" && path != c.Addr {
+		if c.Network != "" && c.Network != "unix" {
+			return fmt.Errorf("proxy: config: listener %q unix socket addr with network %q", c.Name, c.Network)
+		}
+		c.Network, c.Addr = network, path
+	}
+	switch c.Network {
+	case "":
+		c.Network = "tcp"
+		if c.Mode == ListenerModeUDP {
+			c.Network = "udp"
+		}
+	case "tcp", "tcp4", "tcp6", "unix":
+		if c.Mode == ListenerModeUDP {
+			return fmt.Errorf("proxy: config: listener %q udp mode wrong network %q", c.Name, c.Network)
+		}
+	case "udp", "udp4", "udp6":
+		if c.Mode != ListenerModeUDP {
+			return fmt.Errorf("proxy: config: listener %q udp network requires udp mode", c.Name)
+		}
+	default:
+		return fmt.Errorf("proxy: config: listener %q wrong network %q", c.Name, c.Network)
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = ListenerModeMTLS
+	case ListenerModeMTLS, ListenerModeConnect, ListenerModeSOCKS5:
+	case ListenerModePassthrough:
+		if c.ClientId == "" {
+			return fmt.Errorf("proxy: config: listener %q passthrough mode requires client id", c.Name)
+		}
+		// tls not terminated, listener does not advertise ALPN
+		if len(c.ALPN) > 0 {
+			return fmt.Errorf("proxy: config: listener %q passthrough mode does not support alpn", c.Name)
+		}
+	case ListenerModePlain, ListenerModeSOCKS5Plain:
+		// no tls server name and ALPN to route by
+		if len(c.Routes) > 0 || len(c.ALPN) > 0 {
+			return fmt.Errorf("proxy: config: listener %q %v mode does not support routes and alpn", c.Name, c.Mode)
+		}
+	case ListenerModeUDP:
+		if len(c.Routes) > 0 || len(c.ALPN) > 0 || c.ProxyProtocol.Enabled {
+			return fmt.Errorf("proxy: config: listener %q udp mode does not support routes, alpn and proxy protocol", c.Name)
+		}
+	default:
+		return fmt.Errorf("proxy: config: listener %q wrong mode %q", c.Name, c.Mode)
+	}
+	if c.Preamble && c.Mode != ListenerModeMTLS {
+		return fmt.Errorf("proxy: config: listener %q preamble supported only by mtls mode", c.Name)
+	}
+	if c.ClnCACertPath == "" {
+		c.ClnCACertPath = pc.ClnCACertPath
+	}
+	if c.SrvCertPath == "" {
+		c.SrvCertPath = pc.SrvCertPath
+	}
+	if c.SrvKeyPath == "" {
+		c.SrvKeyPath = pc.SrvKeyPath
+	}
+	if c.MaxConns < 0 || c.MaxPendingHandshakes < 0 {
+		return fmt.Errorf("proxy: config: listener %q wrong connection limits", c.Name)
+	}
+	if c.ProxyProtocol.Enabled && len(c.ProxyProtocol.TrustedCIDRs) == 0 && c.Network != "unix" {
+		return fmt.Errorf("proxy: config: listener %q proxy protocol trusted cidrs not set", c.Name)
+	}
+	for _, cidr := range c.ProxyProtocol.TrustedCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("proxy: config: listener %q wrong proxy protocol trusted cidr %q: %w", c.Name, cidr, err)
+		}
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].validate(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminatesTLS reports if listener mode terminates client mTLS
+func (c *ListenerConfig) terminatesTLS() bool {
+	switch c.Mode {
+	case ListenerModeMTLS, ListenerModeConnect, ListenerModeSOCKS5:
+		return true
+	default:
+		return false
+	}
+}
+
+// listener runtime state
+type listener struct {
+	config ListenerConfig
+
+	ln net.Listener
+	// udp mode packet conn (ln not used)
+	pc net.PacketConn
+	// server mTLS config (nil if tls not terminated)
+	tlsConf *tls.Config
+	// PROXY protocol trusted source nets
+	trustedNets []netip.Prefix
+	// default route (listener config)
+	defaultRoute *route
+	// routes by tls server name
+	routes []*route
+	// listener connections admission (parent is proxy admission)
+	admission *admission
+}
+
+func (p *Proxy) newListener(conf ListenerConfig) (*listener, error) {
+	// routes, server certs needed only if tls terminated
+	withCert := conf.terminatesTLS()
+	defaultRoute, err := newRoute(RouteConfig{
+		Pool:           conf.Pool,
+		SrvCertPath:    conf.SrvCertPath,
+		SrvKeyPath:     conf.SrvKeyPath,
+		AllowedClients: conf.AllowedClients,
+		ClientId:       conf.ClientId,
+	}, conf.Name, withCert)
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]*route, 0, len(conf.Routes))
+	for _, rc := range conf.Routes {
+		r, err := newRoute(rc, conf.Name, withCert)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+
+	l := &listener{
+		config:       conf,
+		defaultRoute: defaultRoute,
+		routes:       routes,
+		admission:    newAdmission(conf.MaxConns, conf.MaxPendingHandshakes, nil, p.admission),
+	}
+	if withCert {
+		if l.tlsConf, err = newMTLSConfig(conf, defaultRoute, routes); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range conf.ProxyProtocol.TrustedCIDRs {
+		// validated by config
+		prefix, _ := netip.ParsePrefix(cidr)
+		l.trustedNets = append(l.trustedNets, prefix)
+	}
+
+	if conf.Mode == ListenerModeUDP {
+		if l.pc, err = net.ListenPacket(conf.Network, conf.Addr); err != nil {
+			log.Printf("proxy: listener %v: listen: %v", conf.Name, err)
+			return nil, err
+		}
+		return l, nil
+	}
+	if conf.Network == "unix" {
+		if err := removeStaleUnixSocket(conf.Addr); err != nil {
+			log.Printf("proxy: listener %v: %v", conf.Name, err)
+			return nil, err
+		}
+	}
+	// tls (if terminated) served on accepted conn after PROXY protocol header read
+	// unix socket file removed on listener close
+	if l.ln, err = net.Listen(conf.Network, conf.Addr); err != nil {
+		log.Printf("proxy: listener %v: listen: %v", conf.Name, err)
+		return nil, err
+	}
+	return l, nil
+}
+
+func newMTLSConfig(conf ListenerConfig, defaultRoute *route, routes []*route) (*tls.Config, error) {
+	// Proxy mTLS certificates
+	// client side certificate
+	clnCaCertBytes, err := os.ReadFile(conf.ClnCACertPath)
+	if err != nil {
+		log.Printf("proxy: listener %v: read client CA cert file: %v", conf.Name, err)
+		return nil, err
+	}
+	clnCertPool := x509.NewCertPool()
+	clnCertPool.AppendCertsFromPEM(clnCaCertBytes)
+
+	// advertised ALPN protocols
+	nextProtos := append([]string{}, conf.ALPN...)
+	for _, r := range routes {
+		for _, proto := range r.config.ALPN {
+			if !slices.Contains(nextProtos, proto) {
+				nextProtos = append(nextProtos, proto)
+			}
+		}
+	}
+
+	// Proxy mTLS config
+	// server certificate selected by route of client hello server name and ALPN protocol
+	srvMTLSConf := &tls.Config{
+		MinVersion:               tls.VersionTLS13,
+		PreferServerCipherSuites: true,
+		ClientCAs:                clnCertPool,
+		ClientAuth:               tls.RequireAndVerifyClientCert,
+		NextProtos:               nextProtos,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			proto := negotiatedALPN(nextProtos, hello.SupportedProtos)
+			if r := matchRoute(routes, hello.ServerName, proto); r != nil {
+				return r.cert, nil
+			}
+			return defaultRoute.cert, nil
+		},
+	}
+
+	return srvMTLSConf, nil
+}
+
+// serve serves listener until permanent error
+func (p *Proxy) serve(l *listener) error {
+	if l.pc != nil {
+		return p.serveUDP(l)
+	}
+	return p.acceptLoop(l)
+}
+
+// close closes listener socket
+func (l *listener) close() {
+	if l.pc != nil {
+		connCloseWithLog(l.pc)
+		return
+	}
+	connCloseWithLog(l.ln)
+}
+
+// route return route of tls server name and ALPN protocol, default route if not matched
+func (l *listener) route(serverName string, proto string) *route {
+	if r := matchRoute(l.routes, serverName, proto); r != nil {
+		return r
+	}
+	return l.defaultRoute
+}
+
+// isTrusted reports if PROXY protocol header accepted from conn source addr
+func (l *listener) isTrusted(addr net.Addr) bool {
+	if !l.config.ProxyProtocol.Enabled {
+		return false
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// unix socket
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(ta.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, n := range l.trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import "expvar"
+
+// shed reasons
+const (
+	shedReasonOverload   = "overload"
+	shedReasonMaxConns   = "max_conns"
+	shedReasonMaxPending = "max_pending_handshakes"
+)
+
+// accept error kinds
+const (
+	acceptErrTemporary   = "temporary"
+	acceptErrFDExhausted = "fd_exhausted"
+)
+
+// proxy metrics, published via expvar (see admin api /metrics)
+var (
+	// number of shed connections by reason
+	metricConnsShed = expvar.NewMap("proxy_conns_shed")
+	// current connections (including pending handshakes)
+	metricConns = expvar.NewInt("proxy_conns")
+	// current pending tls handshakes
+	metricPendingHandshakes = expvar.NewInt("proxy_pending_handshakes")
+	// 1 if proxy overloaded (adaptive admission sheds new connections)
+	metricOverloaded = expvar.NewInt("proxy_overloaded")
+	// share of new connections admitted by adaptive admission, per mille
+	metricAdmitRate = expvar.NewInt("proxy_admit_rate")
+	// number of retried accept errors by kind
+	metricAcceptErrors = expvar.NewMap("proxy_accept_errors")
+	// 1 if accept fails with file descriptors exhaustion
+	metricFDExhausted = expvar.NewInt("proxy_fd_exhausted")
+	// current udp flows
+	metricUDPFlows = expvar.NewInt("proxy_udp_flows")
+	// number of dropped udp datagrams (flow not admitted or write failed)
+	metricUDPDropped = expvar.NewInt("proxy_udp_dropped")
+)
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// stops tls handshake after client hello read
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// peekClientHello reads tls client hello from conn
+// return client hello and bytes read from conn (should be sent to upstream before forward)
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, []byte, error) {
+	buf := &bytes.Buffer{}
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+	if hello == nil {
+		if err == nil {
+			err = errors.New("client hello not found")
+		}
+		return nil, buf.Bytes(), err
+	}
+	return hello, buf.Bytes(), nil
+}
+
+// readOnlyConn conn used to read client hello, writes fail
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+var _ net.Conn = readOnlyConn{}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+// preamble line max length
+const preambleMaxLen = 512
+
+// malformed or too long preamble
+var errWrongPreamble = errors.New("wrong preamble")
+
+// readPreamble reads client preamble line sent after tls handshake
+// "pool:<name>" - balance within pool, "upstream:<addr>" - upstream addr (should match configured upstream addr)
+// "any" - balance by route as without preamble
+// selection validated against client perms, reply "OK" when upstream connected, "ERR <reason>" otherwise
+// reason is one of fixed tokens (error details logged by proxy only)
+func readPreamble(sess *session) error {
+	br := bufio.NewReaderSize(sess.conn, preambleMaxLen)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			_ = writePreambleReply(sess.conn, errWrongPreamble)
+		}
+		return err
+	}
+	kind, val, _ := strings.Cut(string(bytes.TrimRight(line, "\r\n")), ":")
+	switch {
+	case kind == "pool" && val != "":
+		sess.targetPool = val
+	case kind == "upstream" && val != "":
+		sess.target = val
+	case kind == "any" && val == "":
+	default:
+		_ = writePreambleReply(sess.conn, errWrongPreamble)
+		return fmt.Errorf("%w %q", errWrongPreamble, line)
+	}
+	// stream bytes sent by client right after preamble
+	if n := br.Buffered(); n > 0 {
+		sess.prefix, _ = br.Peek(n)
+	}
+	sess.reply = func(err error) error {
+		return writePreambleReply(sess.conn, err)
+	}
+	return nil
+}
+
+// writePreambleReply writes "OK" or "ERR <reason>"
+// reasons: bad-request, forbidden, too-many (client connections limit), unavailable
+func writePreambleReply(w io.Writer, err error) error {
+	reply := "OK\n"
+	switch {
+	case err == nil:
+	case errors.Is(err, errWrongPreamble):
+		reply = "ERR bad-request\n"
+	case errors.Is(err, balancer.ErrUpstreamNotAllowed),
+		errors.Is(err, balancer.ErrPoolNotFound),
+		errors.Is(err, balancer.ErrClientNotConfig),
+		errors.Is(err, ErrClientNotAllowed):
+		reply = "ERR forbidden\n"
+	case errors.Is(err, balancer.ErrClientExceedLimti):
+		reply = "ERR too-many\n"
+	default:
+		// upstream not available or dial error
+		reply = "ERR unavailable\n"
+	}
+	_, werr := io.WriteString(w, reply)
+	return werr
+}
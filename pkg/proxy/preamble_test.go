@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+func TestReadPreamble(t *testing.T) {
+	tests := []struct {
+		name       string
+		sent       string
+		targetPool string
+		target     string
+		prefix     string
+		// reply written on error (empty if no reply)
+		reply string
+		ok    bool
+	}{
+		{name: "pool", sent: "pool:p\n", targetPool: "p", ok: true},
+		{name: "upstream", sent: "upstream:u1:80\r\n", target: "u1:80", ok: true},
+		{name: "any", sent: "any\n", ok: true},
+		// stream bytes sent with preamble forwarded to upstream
+		{name: "buffered data", sent: "any\nhello", prefix: "hello", ok: true},
+		{name: "empty pool", sent: "pool:\n", reply: "ERR bad-request\n"},
+		{name: "any with value", sent: "any:p\n", reply: "ERR bad-request\n"},
+		{name: "unknown kind", sent: "host:u1\n", reply: "ERR bad-request\n"},
+		{name: "too long", sent: "pool:" + strings.Repeat("p", preambleMaxLen) + "\n", reply: "ERR bad-request\n"},
+		// client gone, no reply
+		{name: "no line end", sent: "pool:p"},
+	}
+	for _, tt := range tests {
+		conn := newBufConn(tt.sent)
+		sess := &session{conn: conn}
+		err := readPreamble(sess)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%v: error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if sess.targetPool != tt.targetPool || sess.target != tt.target || string(sess.prefix) != tt.prefix {
+			t.Fatalf("%v: pool %q target %q prefix %q, want %q %q %q",
+				tt.name, sess.targetPool, sess.target, sess.prefix, tt.targetPool, tt.target, tt.prefix)
+		}
+		if conn.w.String() != tt.reply {
+			t.Fatalf("%v: reply %q, want %q", tt.name, conn.w.String(), tt.reply)
+		}
+	}
+}
+
+func TestWritePreambleReply(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: "OK\n"},
+		{err: fmt.Errorf("%w %q", errWrongPreamble, "x"), want: "ERR bad-request\n"},
+		{err: balancer.ErrUpstreamNotAllowed, want: "ERR forbidden\n"},
+		{err: balancer.ErrPoolNotFound, want: "ERR forbidden\n"},
+		{err: balancer.ErrClientNotConfig, want: "ERR forbidden\n"},
+		{err: ErrClientNotAllowed, want: "ERR forbidden\n"},
+		{err: balancer.ErrClientExceedLimti, want: "ERR too-many\n"},
+		{err: balancer.ErrCanNotGetUpstream, want: "ERR unavailable\n"},
+		// error details not sent to client
+		{err: errors.New("dial tcp 10.0.0.1:80: connection refused"), want: "ERR unavailable\n"},
+	}
+	for _, tt := range tests {
+		conn := newBufConn("")
+		if err := writePreambleReply(conn, tt.err); err != nil {
+			t.Fatal(err)
+		}
+		if conn.w.String() != tt.want {
+			t.Errorf("writePreambleReply(%v) = %q, want %q", tt.err, conn.w.String(), tt.want)
+		}
+	}
+}
@@ -3,12 +3,13 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
+	"fmt"
 	"log"
 	"net"
-	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/radisvaliullin/proxy/pkg/auth"
@@ -20,6 +21,21 @@ type Proxy struct {
 
 	auth   auth.IAuth
 	blncer balancer.IBalancer
+
+	// forward buffers pool (ForwardBuffSize)
+	buffPool *sync.Pool
+
+	// upstream dialers (set in Start)
+	upstrDialers []*upstreamDialer
+	// dialer of upstreams without settings
+	defaultDialer *upstreamDialer
+
+	// connections admission
+	admission *admission
+	// adaptive admission state, sheds share of new connections
+	overload *overload
+	// accept fails with file descriptors exhaustion
+	fdExhausted atomic.Bool
 }
 
 func New(conf Config, au auth.IAuth, blncer balancer.IBalancer) (*Proxy, error) {
@@ -27,59 +43,169 @@ func New(conf Config, au auth.IAuth, blncer balancer.IBalancer) (*Proxy, error)
 		return nil, err
 	}
 	p := &Proxy{
-		config: conf,
-		auth:   au,
-		blncer: blncer,
+		config:   conf,
+		auth:     au,
+		blncer:   blncer,
+		buffPool: newBuffPool(conf.ForwardBuffSize),
+		overload: newOverload(),
+	}
+	p.admission = newAdmission(conf.MaxConns, conf.MaxPendingHandshakes, p.overload, nil)
+	// listeners and routes should reference configured pools and clients
+	for _, lc := range conf.Listeners {
+		if err := p.validateRefs(lc.Name, lc.Pool, withClientId(lc.AllowedClients, lc.ClientId)); err != nil {
+			return nil, err
+		}
+		for _, rc := range lc.Routes {
+			if err := p.validateRefs(lc.Name, rc.Pool, withClientId(rc.AllowedClients, rc.ClientId)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, uc := range conf.Upstreams {
+		if uc.Pool != "" && !blncer.HasPool(uc.Pool) {
+			log.Printf("proxy: config: upstream settings reference unknown pool %q", uc.Pool)
+			return nil, balancer.ErrPoolNotFound
+		}
 	}
 	return p, nil
 }
 
+// validateRefs checks that pool and clients referenced by listener config exist
+func (p *Proxy) validateRefs(listenerName string, pool string, clients []string) error {
+	if pool != "" && !p.blncer.HasPool(pool) {
+		log.Printf("proxy: config: listener %v references unknown pool %q", listenerName, pool)
+		return balancer.ErrPoolNotFound
+	}
+	for _, id := range clients {
+		if !p.auth.AuthN(id) {
+			log.Printf("proxy: config: listener %v references unknown client %q", listenerName, id)
+			return fmt.Errorf("proxy: config: listener %v: unknown client %q", listenerName, id)
+		}
+	}
+	return nil
+}
+
+// withClientId return clients with session client id (if set)
+func withClientId(clients []string, clientId string) []string {
+	if clientId == "" {
+		return clients
+	}
+	return append(append([]string{}, clients...), clientId)
+}
+
 func (p *Proxy) Start() error {
 	log.Print("proxy: start.")
 
-	// Proxy mTLS certificates
-	// client side certificate
-	clnCaCertBytes, err := os.ReadFile(p.config.ClnCACertPath)
+	res := newResolver()
+	defaultConf := UpstreamConfig{}
+	defaultConf.setDefaults()
+	d, err := newUpstreamDialer(defaultConf, res)
 	if err != nil {
-		log.Printf("proxy: start: read client CA cert file: %v", err)
 		return err
 	}
-	clnCertPool := x509.NewCertPool()
-	clnCertPool.AppendCertsFromPEM(clnCaCertBytes)
-	// server side certificate
-	srvCert, err := tls.LoadX509KeyPair(p.config.SrvCertPath, p.config.SrvKeyPath)
-	if err != nil {
-		log.Printf("proxy: start: server cert load: %v", err)
-		return nil
+	p.defaultDialer = d
+	for _, uc := range p.config.Upstreams {
+		d, err := newUpstreamDialer(uc, res)
+		if err != nil {
+			return err
+		}
+		p.upstrDialers = append(p.upstrDialers, d)
+	}
+
+	listeners := make([]*listener, 0, len(p.config.Listeners))
+	for _, lc := range p.config.Listeners {
+		l, err := p.newListener(lc)
+		if err != nil {
+			for _, l := range listeners {
+				l.close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
 	}
 
-	// Proxy mTLS config
-	srvMTLSConf := &tls.Config{
-		MinVersion:               tls.VersionTLS13,
-		PreferServerCipherSuites: true,
-		ClientCAs:                clnCertPool,
-		ClientAuth:               tls.RequireAndVerifyClientCert,
-		Certificates:             []tls.Certificate{srvCert},
+	if p.config.Overload.enabled() {
+		go overloadMonitor(p.config.Overload, p.overload)
 	}
 
-	ln, err := tls.Listen("tcp", p.config.Addr, srvMTLSConf)
-	if err != nil {
-		log.Printf("proxy: start: listen: %v", err)
-		return err
+	// run listeners, return on first listener permanent error
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		go func() {
+			log.Printf("proxy: listener %v: listen %v %v", l.config.Name, l.config.Network, l.config.Addr)
+			errCh <- p.serve(l)
+		}()
 	}
+	err = <-errCh
+	for _, l := range listeners {
+		l.close()
+	}
+	return err
+}
 
+// acceptLoop accepts connections until permanent accept error
+// temporary errors retried with exponential backoff (as net/http server does)
+// file descriptors exhaustion reported as overload state until next successful accept
+func (p *Proxy) acceptLoop(l *listener) error {
+	// how long to sleep on accept failure
+	var tempDelay time.Duration
 	for {
-		conn, err := ln.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
-			log.Printf("proxy: start: accept tls conn: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("proxy: accept: listener closed: %v", err)
+				return err
+			}
+			fdExhausted := errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+			var ne net.Error
+			if !fdExhausted && !(errors.As(err, &ne) && ne.Temporary()) {
+				log.Printf("proxy: accept: permanent error: %v", err)
+				return err
+			}
+			if fdExhausted {
+				metricAcceptErrors.Add(acceptErrFDExhausted, 1)
+				if !p.fdExhausted.Swap(true) {
+					log.Printf("proxy: accept: overload, file descriptors exhausted")
+					metricFDExhausted.Set(1)
+				}
+			} else {
+				metricAcceptErrors.Add(acceptErrTemporary, 1)
+			}
+			tempDelay = retryDelay(tempDelay)
+			log.Printf("proxy: accept: error: %v; retrying in %v", err, tempDelay)
+			time.Sleep(tempDelay)
 			continue
 		}
+		tempDelay = 0
+		if p.fdExhausted.Swap(false) {
+			log.Printf("proxy: accept: file descriptors available again")
+			metricFDExhausted.Set(0)
+		}
 
-		go p.handleConn(conn)
+		// shed excess connections before handshake
+		if !l.admission.admit() {
+			connCloseWithLog(conn)
+			continue
+		}
+		go p.handleConn(conn, l)
 	}
 }
 
-func (p *Proxy) handleConn(conn net.Conn) {
+// retryDelay return next delay of retried accept (read) error
+// exponential backoff from 5ms to 1s, zero delay - first retry
+func retryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	delay *= 2
+	if maxDelay := 1 * time.Second; delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func (p *Proxy) handleConn(conn net.Conn, l *listener) {
 	log.Printf("proxy: handler: forward")
 	defer log.Printf("proxy: handler: done")
 
@@ -87,63 +213,126 @@ func (p *Proxy) handleConn(conn net.Conn) {
 	wg := sync.WaitGroup{}
 	wg.Wait()
 	// conn close (release read/write operations)
-	defer connCloseWithLog(conn)
+	// conn replaced by session client conn (tls conn if tls terminated)
+	defer func() { connCloseWithLog(conn) }()
+	defer l.admission.release()
 
-	// auth connection
-	clnId, err := p.authzConn(conn)
+	// auth connection and resolve route by listener mode
+	sess, err := p.identify(conn, l)
+	l.admission.handshakeDone()
 	if err != nil {
 		log.Printf("proxy: handler: conn auth: %v", err)
 		return
 	}
+	conn = sess.conn
+	clnId, rt := sess.clientId, sess.route
+	log.Printf("proxy: handler: listener %v: client %v from %v", l.config.Name, clnId, sess.srcAddr)
+	if !rt.isAllowed(clnId) {
+		log.Printf("proxy: handler: listener %v: client %v not allowed for server name %q alpn %q", l.config.Name, clnId, sess.serverName, sess.proto)
+		sess.replyWithLog(ErrClientNotAllowed)
+		return
+	}
 
 	// get upstream address
-	upstr, err := p.blncer.Balance(clnId)
+	upstr, err := p.balance(sess)
 	if err != nil {
 		log.Printf("proxy: handler: conn balance, get upstream addr: %v", err)
+		sess.replyWithLog(err)
 		return
 	}
-	defer upstr.Close()
+	// session error reported to balancer on upstream release
+	var sessErr error
+	defer func() { upstr.Close(sessErr) }()
 
 	// dial upstream
-	dialer := DefaultDialer()
-	upstrmConn, err := dialer.Dial("tcp", upstr.Addr())
+	upstrmConn, err := p.upstreamDialer(upstr).dial(upstr.Addr(), sess.dialInfo())
+	if err == nil && len(sess.prefix) > 0 {
+		// peeked client bytes
+		if _, err = upstrmConn.Write(sess.prefix); err != nil {
+			connCloseWithLog(upstrmConn)
+		}
+	}
+	upstr.Dialed(err)
 	if err != nil {
 		log.Printf("proxy: handler: upstream dial: %v", err)
+		sess.replyWithLog(err)
 		return
 	}
 	defer connCloseWithLog(upstrmConn)
+	if !sess.replyWithLog(nil) {
+		return
+	}
 
 	// cancel session
 	// if one of forward functions fail when need graceful cancel session
 	// and conn handler should return and defer conn close
-	sessCtx, sessCancel := context.WithCancel(context.Background())
+	// cancel cause is first forward error (context.Canceled if forward done without error)
+	// session max duration (cancel cause ErrSessionMaxDuration)
+	idleTimeout, maxDuration := p.sessionTimeouts(clnId)
+	sessParentCtx := context.Background()
+	if maxDuration > 0 {
+		var cancel context.CancelFunc
+		sessParentCtx, cancel = context.WithTimeoutCause(sessParentCtx, maxDuration, ErrSessionMaxDuration)
+		defer cancel()
+	}
+	sessCtx, sessCancel := context.WithCancelCause(sessParentCtx)
 
 	// forward conn->upstream and upstream->conn
-	hbDuration := time.Duration(time.Second * time.Duration(p.config.HeartbeatTimeout))
-	rwBuffSize := p.config.ForwardBuffSize
+	// direction done without error (EOF) propagates half-close to destination conn
+	// and other direction continues, session canceled when both directions done or on first error
+	// each direction tracks own idle timeout (heartbeat), in combined idle mode tracker is shared
+	inTracker, outTracker := newIdleTracker(idleTimeout), newIdleTracker(idleTimeout)
+	if p.config.IdleMode == IdleModeCombined {
+		outTracker = inTracker
+	}
+	var dirsDone int32
+	dirDone := func(out net.Conn) {
+		closeWriteWithLog(out)
+		if atomic.AddInt32(&dirsDone, 1) == 2 {
+			sessCancel(nil)
+		}
+	}
 	wg.Add(1)
 	go func() {
 		wg.Done()
-		defer sessCancel()
-		if err := streamForwarderWithHeartbeat(sessCancel, upstrmConn, conn, hbDuration, rwBuffSize); err != nil {
-			log.Printf("proxy: handler: forward conn to upstrmConn: %v", err)
+		if err := streamForwarder(upstrmConn, conn, inTracker, p.buffPool); err != nil {
+			log.Printf("proxy: handler: forward upstrmConn to conn: %v", err)
+			sessCancel(err)
 			return
 		}
+		dirDone(conn)
 	}()
 	wg.Add(1)
 	go func() {
 		wg.Done()
-		defer sessCancel()
-		if err := streamForwarderWithHeartbeat(sessCancel, conn, upstrmConn, hbDuration, rwBuffSize); err != nil {
-			log.Printf("proxy: handler: forward upstrmConn to conn: %v", err)
+		if err := streamForwarder(conn, upstrmConn, outTracker, p.buffPool); err != nil {
+			log.Printf("proxy: handler: forward conn to upstrmConn: %v", err)
+			sessCancel(err)
 			return
 		}
+		dirDone(upstrmConn)
 	}()
 
-	// lock until context canceled by one of forward goroutines
-	<-sessCtx.Done()
+	// lock until context canceled by forward goroutines
+	// or balancer force closes session (upstream drain timeout)
+	select {
+	case <-sessCtx.Done():
+		err := context.Cause(sessCtx)
+		if errors.Is(err, ErrSessionMaxDuration) {
+			log.Printf("proxy: handler: %v", err)
+		} else if isConnError(err, upstrmConn) {
+			// only upstream side errors are upstream failures (not client resets, idle timeouts)
+			// error of spliced copy is error of both conns, so counted as upstream failure
+			sessErr = err
+		}
+	case <-upstr.Done():
+		log.Printf("proxy: handler: %v", ErrSessionForceClosed)
+		sessCancel(ErrSessionForceClosed)
+	}
 }
 
+// authzConn handshakes tls conn and authenticates client by client cert
+// handshake timeout set by caller (conn deadline)
 func (a *Proxy) authzConn(conn net.Conn) (string, error) {
 	var (
 		tc *tls.Conn
@@ -168,3 +357,18 @@ func (a *Proxy) authzConn(conn net.Conn) (string, error) {
 
 	return id, nil
 }
+
+// sessionTimeouts return idle timeout and max session duration (0 no limit) of client session
+// client perms override proxy config
+func (p *Proxy) sessionTimeouts(clientId string) (idle time.Duration, maxDuration time.Duration) {
+	idleSec, maxSec := p.config.HeartbeatTimeout, p.config.MaxSessionDuration
+	if perms, ok := p.auth.ClientPerms(clientId); ok {
+		if perms.IdleTimeout > 0 {
+			idleSec = perms.IdleTimeout
+		}
+		if perms.MaxSessionDuration > 0 {
+			maxSec = perms.MaxSessionDuration
+		}
+	}
+	return time.Duration(idleSec) * time.Second, time.Duration(maxSec) * time.Second
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// delay between Happy Eyeballs connection attempts (RFC 8305)
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// max time of shared host lookup (lookup not canceled by caller which started it)
+const resolveTimeout = 15 * time.Second
+
+// expired addrs kept for lookup error fallback, removed from cache after
+// (hosts of removed upstreams not kept forever)
+const resolveStaleKeep = time.Hour
+
+// resolver resolves upstream host names and caches addrs for ttl
+// (system resolver does not expose record ttl, so ttl set by upstream config)
+// concurrent lookups of same host deduplicated
+type resolver struct {
+	mx    sync.Mutex
+	cache map[resolveKey]resolved
+	// in-flight lookups by host
+	group singleflight.Group
+
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	// cache clock (time.Now)
+	now func() time.Time
+}
+
+// resolve cache key, ttl set per upstream so same host cached separately for each ttl
+type resolveKey struct {
+	host string
+	ttl  time.Duration
+}
+
+// resolved host addrs
+type resolved struct {
+	addrs    []netip.Addr
+	expireAt time.Time
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		cache: make(map[resolveKey]resolved),
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		now: time.Now,
+	}
+}
+
+// resolve return host addrs, cached addrs used until ttl expired
+// on lookup error expired addrs used if any
+// returned addrs shared, should not be modified
+func (r *resolver) resolve(ctx context.Context, host string, ttl time.Duration) ([]netip.Addr, error) {
+	key := resolveKey{host: host, ttl: ttl}
+	r.mx.Lock()
+	res, ok := r.cache[key]
+	r.mx.Unlock()
+	if ok && r.now().Before(res.expireAt) {
+		return res.addrs, nil
+	}
+
+	// lookup shared by concurrent callers, each caller waits until own ctx done
+	ch := r.group.DoChan(host, func() (any, error) {
+		lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), resolveTimeout)
+		defer cancel()
+		addrs, err := r.lookup(lookupCtx, host)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no addrs")
+		}
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		return addrs, err
+	})
+	var (
+		addrs []netip.Addr
+		err   error
+	)
+	select {
+	case sr := <-ch:
+		addrs, err = sr.Val.([]netip.Addr), sr.Err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		if ok {
+			log.Printf("proxy: resolver: lookup %v: %v, use expired addrs", host, err)
+			return res.addrs, nil
+		}
+		return nil, err
+	}
+	now := r.now()
+	r.mx.Lock()
+	r.cache[key] = resolved{addrs: addrs, expireAt: now.Add(ttl)}
+	r.evictNotSafe(now)
+	r.mx.Unlock()
+	return addrs, nil
+}
+
+// evictNotSafe removes entries expired longer than stale keep time
+func (r *resolver) evictNotSafe(now time.Time) {
+	for key, res := range r.cache {
+		if now.Sub(res.expireAt) > resolveStaleKeep {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// interleaveFamilies orders addrs alternating address families, first family of addrs first (RFC 8305)
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	var first, second []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == addrs[0].Is4() {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialFunc dials network address (net.Dialer DialContext)
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialHappyEyeballs races tcp connections to addrs (Happy Eyeballs, RFC 8305)
+// next attempt starts after delay or when previous attempt fails, first connected wins
+func dialHappyEyeballs(ctx context.Context, dial dialFunc, addrs []netip.Addr, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := netip.AddrPortFrom(addrs[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, "tcp", addr.String())
+			results <- result{conn: conn, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// attempts still in progress canceled, connections won race later closed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							connCloseWithLog(r.conn)
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
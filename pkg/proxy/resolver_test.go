@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock resolver clock moved by test
+type testClock struct {
+	mx  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testResolver return resolver with injected lookup, test clock and lookups counter
+func testResolver(lookup func(host string) ([]netip.Addr, error)) (*resolver, *testClock, *atomic.Int32) {
+	var calls atomic.Int32
+	clock := &testClock{now: time.Now()}
+	r := newResolver()
+	r.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		calls.Add(1)
+		return lookup(host)
+	}
+	r.now = clock.Now
+	return r, clock, &calls
+}
+
+func addrs(ss ...string) []netip.Addr {
+	out := make([]netip.Addr, 0, len(ss))
+	for _, s := range ss {
+		out = append(out, netip.MustParseAddr(s))
+	}
+	return out
+}
+
+func TestResolverCacheTTL(t *testing.T) {
+	r, clock, calls := testResolver(func(host string) ([]netip.Addr, error) {
+		return addrs("10.0.0.1"), nil
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := r.resolve(ctx, "a.test", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("lookups %v, want 1 (cached)", n)
+	}
+
+	// same host with other ttl cached separately, short ttl does not expire long ttl entry
+	if _, err := r.resolve(ctx, "a.test", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(20 * time.Millisecond)
+	if _, err := r.resolve(ctx, "a.test", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("lookups %v, want 2", n)
+	}
+	if _, err := r.resolve(ctx, "a.test", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("lookups %v, want 3 (short ttl expired)", n)
+	}
+}
+
+func TestResolverExpiredFallback(t *testing.T) {
+	lookupErr := errors.New("lookup failed")
+	fail := false
+	r, clock, _ := testResolver(func(host string) ([]netip.Addr, error) {
+		if fail {
+			return nil, lookupErr
+		}
+		// v4-mapped addr unmapped
+		return addrs("::ffff:10.0.0.1"), nil
+	})
+	ctx := context.Background()
+	if _, err := r.resolve(ctx, "a.test", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(5 * time.Millisecond)
+	fail = true
+	got, err := r.resolve(ctx, "a.test", time.Millisecond)
+	if err != nil {
+		t.Fatalf("expired addrs not used: %v", err)
+	}
+	if want := addrs("10.0.0.1"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("addrs %v, want %v", got, want)
+	}
+	// not cached host
+	if _, err := r.resolve(ctx, "b.test", time.Millisecond); !errors.Is(err, lookupErr) {
+		t.Fatalf("error %v, want %v", err, lookupErr)
+	}
+	// empty lookup result is error
+	fail = false
+	r.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) { return nil, nil }
+	if _, err := r.resolve(ctx, "c.test", time.Millisecond); err == nil {
+		t.Fatal("no error of empty lookup result")
+	}
+}
+
+func TestResolverSingleflight(t *testing.T) {
+	release := make(chan struct{})
+	r, _, calls := testResolver(func(host string) ([]netip.Addr, error) {
+		<-release
+		return addrs("10.0.0.1"), nil
+	})
+	const callers = 10
+	wg := sync.WaitGroup{}
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// callers started after lookup done get cached addrs
+			_, err := r.resolve(context.Background(), "a.test", time.Hour)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("lookups %v, want 1", n)
+	}
+}
+
+func TestResolverCallerCanceled(t *testing.T) {
+	release := make(chan struct{})
+	r, _, _ := testResolver(func(host string) ([]netip.Addr, error) {
+		<-release
+		return addrs("10.0.0.1"), nil
+	})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := r.resolve(ctx, "a.test", time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestResolverEviction(t *testing.T) {
+	r, clock, _ := testResolver(func(host string) ([]netip.Addr, error) {
+		return addrs("10.0.0.1"), nil
+	})
+	ctx := context.Background()
+	for _, host := range []string{"a.test", "b.test"} {
+		if _, err := r.resolve(ctx, host, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		clock.Add(resolveStaleKeep / 2)
+	}
+	// a.test expired longer than stale keep time, b.test expired recently (kept for fallback)
+	clock.Add(resolveStaleKeep / 2)
+	if _, err := r.resolve(ctx, "c.test", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if len(r.cache) != 2 {
+		t.Fatalf("cache %v, want b.test and c.test", r.cache)
+	}
+	if _, ok := r.cache[resolveKey{host: "a.test", ttl: time.Minute}]; ok {
+		t.Fatal("stale entry not evicted")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	tests := []struct {
+		in   []netip.Addr
+		want []netip.Addr
+	}{
+		{in: nil, want: nil},
+		{in: addrs("10.0.0.1", "10.0.0.2"), want: addrs("10.0.0.1", "10.0.0.2")},
+		{
+			in:   addrs("::1", "::2", "::3", "10.0.0.1"),
+			want: addrs("::1", "10.0.0.1", "::2", "::3"),
+		},
+		{
+			in:   addrs("10.0.0.1", "10.0.0.2", "::1", "::2"),
+			want: addrs("10.0.0.1", "::1", "10.0.0.2", "::2"),
+		},
+	}
+	for _, tt := range tests {
+		if got := interleaveFamilies(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("interleaveFamilies(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fakeDial dial result of addr
+type fakeDial struct {
+	delay time.Duration
+	err   error
+	// dial blocked until ctx canceled
+	hang bool
+}
+
+// fakeDialer return dial func of addr results and started dials log
+func fakeDialer(results map[string]fakeDial) (dialFunc, func() []string) {
+	var (
+		mx      sync.Mutex
+		started []string
+	)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		mx.Lock()
+		started = append(started, address)
+		mx.Unlock()
+		res := results[address]
+		if res.hang {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		select {
+		case <-time.After(res.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if res.err != nil {
+			return nil, res.err
+		}
+		c, s := net.Pipe()
+		s.Close()
+		return c, nil
+	}
+	log := func() []string {
+		mx.Lock()
+		defer mx.Unlock()
+		return append([]string{}, started...)
+	}
+	return dial, log
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	refused := errors.New("refused")
+	ips := addrs("::1", "10.0.0.1", "::2")
+
+	t.Run("first fails, next started without delay", func(t *testing.T) {
+		dial, started := fakeDialer(map[string]fakeDial{
+			"[::1]:80": {err: refused},
+		})
+		start := time.Now()
+		conn, err := dialHappyEyeballs(context.Background(), dial, ips, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if d := time.Since(start); d >= happyEyeballsDelay {
+			t.Fatalf("dial took %v, want less than attempt delay", d)
+		}
+		if got := started(); !reflect.DeepEqual(got, []string{"[::1]:80", "10.0.0.1:80"}) {
+			t.Fatalf("started %v", got)
+		}
+	})
+
+	t.Run("first hangs, next started after delay", func(t *testing.T) {
+		dial, started := fakeDialer(map[string]fakeDial{
+			"[::1]:80": {hang: true},
+		})
+		start := time.Now()
+		conn, err := dialHappyEyeballs(context.Background(), dial, ips, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		// upper bound loose, only checks next attempt not waits first attempt
+		if d := time.Since(start); d < happyEyeballsDelay || d > happyEyeballsDelay+5*time.Second {
+			t.Fatalf("dial took %v, want about attempt delay %v", d, happyEyeballsDelay)
+		}
+		if got := started(); !reflect.DeepEqual(got, []string{"[::1]:80", "10.0.0.1:80"}) {
+			t.Fatalf("started %v", got)
+		}
+	})
+
+	t.Run("all fail, first error returned", func(t *testing.T) {
+		other := errors.New("other")
+		dial, started := fakeDialer(map[string]fakeDial{
+			"[::1]:80":    {err: refused},
+			"10.0.0.1:80": {err: other},
+			"[::2]:80":    {err: other},
+		})
+		if _, err := dialHappyEyeballs(context.Background(), dial, ips, 80); !errors.Is(err, refused) {
+			t.Fatalf("error %v, want %v", err, refused)
+		}
+		if got := started(); len(got) != len(ips) {
+			t.Fatalf("started %v, want all addrs", got)
+		}
+	})
+
+	t.Run("ctx canceled", func(t *testing.T) {
+		dial, _ := fakeDialer(map[string]fakeDial{
+			"[::1]:80":    {hang: true},
+			"10.0.0.1:80": {hang: true},
+			"[::2]:80":    {hang: true},
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), happyEyeballsDelay/2)
+		defer cancel()
+		if _, err := dialHappyEyeballs(ctx, dial, ips, 80); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
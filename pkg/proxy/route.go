@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// RouteConfig listener route selected by tls server name (SNI) and negotiated ALPN protocol
+// empty fields use listener config values
+type RouteConfig struct {
+	// server names of route (empty - any server name)
+	// wildcard name "*.example.com" matches one label ("a.example.com" but not "a.b.example.com")
+	ServerNames []string `yaml:"serverNames"`
+	// ALPN protocols of route (empty - any protocol)
+	// route protocols advertised by listener
+	ALPN []string `yaml:"alpn"`
+	// re-advertise negotiated ALPN protocol when proxy originates tls to upstream
+	ALPNPassthrough bool `yaml:"alpnPassthrough"`
+	// upstream pool of route
+	Pool string `yaml:"pool"`
+	// Server Cert and Key file path
+	SrvCertPath string `yaml:"serverCertPath"`
+	SrvKeyPath  string `yaml:"serverKeyPath"`
+	// client ids allowed on route
+	AllowedClients []string `yaml:"allowedClients"`
+	// client id of route sessions (passthrough listener mode, client certificate not visible)
+	ClientId string `yaml:"clientId"`
+}
+
+func (c *RouteConfig) validate(lc *ListenerConfig) error {
+	if len(c.ServerNames) == 0 && len(c.ALPN) == 0 {
+		return fmt.Errorf("proxy: config: listener %q route without server names and alpn", lc.Name)
+	}
+	// ALPN protocol negotiated by upstream in passthrough mode, route with ALPN never matched
+	if lc.Mode == ListenerModePassthrough && len(c.ALPN) > 0 {
+		return fmt.Errorf("proxy: config: listener %q passthrough mode route matched only by server names, alpn %v", lc.Name, c.ALPN)
+	}
+	for i, n := range c.ServerNames {
+		n = strings.ToLower(n)
+		if n == "" || (strings.Contains(n, "*") && (!strings.HasPrefix(n, "*.") || strings.Count(n, "*") > 1)) {
+			return fmt.Errorf("proxy: config: listener %q route wrong server name %q", lc.Name, n)
+		}
+		c.ServerNames[i] = n
+	}
+	if c.Pool == "" {
+		c.Pool = lc.Pool
+	}
+	if c.SrvCertPath == "" && c.SrvKeyPath == "" {
+		c.SrvCertPath, c.SrvKeyPath = lc.SrvCertPath, lc.SrvKeyPath
+	}
+	if len(c.AllowedClients) == 0 {
+		c.AllowedClients = lc.AllowedClients
+	}
+	if c.ClientId == "" {
+		c.ClientId = lc.ClientId
+	}
+	return nil
+}
+
+// route runtime state
+type route struct {
+	config RouteConfig
+
+	cert *tls.Certificate
+	// allowed client ids (empty - all clients)
+	allowedClients map[string]struct{}
+}
+
+// withCert - load route server certificate (not needed if tls not terminated)
+func newRoute(conf RouteConfig, listenerName string, withCert bool) (*route, error) {
+	r := &route{
+		config:         conf,
+		allowedClients: make(map[string]struct{}, len(conf.AllowedClients)),
+	}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(conf.SrvCertPath, conf.SrvKeyPath)
+		if err != nil {
+			log.Printf("proxy: listener %v: route %v: server cert load: %v", listenerName, conf.ServerNames, err)
+			return nil, err
+		}
+		r.cert = &cert
+	}
+	for _, id := range conf.AllowedClients {
+		r.allowedClients[id] = struct{}{}
+	}
+	return r, nil
+}
+
+// isAllowed reports if client allowed on route
+func (r *route) isAllowed(clientId string) bool {
+	if len(r.allowedClients) == 0 {
+		return true
+	}
+	_, ok := r.allowedClients[clientId]
+	return ok
+}
+
+// matchRoute return route by server name and negotiated ALPN protocol
+// route ALPN should contain protocol (if route ALPN set)
+// routes with exact server name preferred, then wildcard server name, then routes without server names
+// routes with same preference checked in config order
+// return nil if route not found
+func matchRoute(routes []*route, serverName string, proto string) *route {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	var (
+		best      *route
+		bestScore int
+	)
+	for _, r := range routes {
+		if len(r.config.ALPN) > 0 && !slices.Contains(r.config.ALPN, proto) {
+			continue
+		}
+		score := matchServerName(r.config.ServerNames, name)
+		if score > 0 && (best == nil || score > bestScore) {
+			best, bestScore = r, score
+		}
+	}
+	return best
+}
+
+// server name match score
+// 3 - exact match, 2 - wildcard match, 1 - route without server names, 0 - not matched
+func matchServerName(names []string, name string) int {
+	if len(names) == 0 {
+		return 1
+	}
+	if name == "" {
+		return 0
+	}
+	score := 0
+	for _, n := range names {
+		if n == name {
+			return 3
+		}
+		// wildcard matches one label
+		if dot := strings.IndexByte(name, '.'); dot > 0 && strings.HasPrefix(n, "*.") && n[1:] == name[dot:] {
+			score = 2
+		}
+	}
+	return score
+}
+
+// negotiatedALPN return protocol negotiated by tls server (first server protocol supported by client)
+func negotiatedALPN(serverProtos, clientProtos []string) string {
+	for _, p := range serverProtos {
+		if slices.Contains(clientProtos, p) {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+	"github.com/radisvaliullin/proxy/pkg/proxyproto"
+)
+
+// session client connection info resolved by listener mode
+type session struct {
+	// client conn used to forward (tls conn if tls terminated by proxy)
+	conn     net.Conn
+	clientId string
+	route    *route
+	// tls server name and ALPN protocol
+	serverName string
+	proto      string
+	// passthrough session (tls not terminated by proxy)
+	passthrough bool
+	// client conn source (real client addr if PROXY protocol header accepted) and destination (listener) addrs
+	srcAddr net.Addr
+	dstAddr net.Addr
+	// tls version and client cert (tls terminated by proxy)
+	tlsVersion uint16
+	clientCert *x509.Certificate
+	// bytes read from client conn (peeked), sent to upstream before forward
+	prefix []byte
+	// upstream addr or pool selected by client (empty - balanced in route pool)
+	target     string
+	targetPool string
+	// reply sends front end protocol reply to client when upstream connected or failed
+	// (nil if front end protocol has no reply)
+	reply func(err error) error
+}
+
+// dialInfo return session info used by upstream dial
+func (s *session) dialInfo() dialInfo {
+	di := dialInfo{
+		passthrough: s.passthrough,
+		srcAddr:     s.srcAddr,
+		dstAddr:     s.dstAddr,
+		clientId:    s.clientId,
+		serverName:  s.serverName,
+		tlsVersion:  s.tlsVersion,
+	}
+	if s.clientCert != nil {
+		fp := sha256.Sum256(s.clientCert.Raw)
+		di.certFingerprint = fp[:]
+	}
+	// upstream tls origination advertises client ALPN protocol if route passthrough it
+	if s.route.config.ALPNPassthrough {
+		di.proto = s.proto
+	}
+	return di
+}
+
+// replyWithLog sends front end reply of upstream connect result (err nil - connected)
+// return false if reply failed
+func (s *session) replyWithLog(err error) bool {
+	if s.reply == nil {
+		return true
+	}
+	if rerr := s.reply(err); rerr != nil {
+		log.Printf("proxy: handler: client %v: reply: %v", s.clientId, rerr)
+		return false
+	}
+	return true
+}
+
+// balance return session upstream, upstream selected by client preferred
+func (p *Proxy) balance(sess *session) (balancer.Upstream, error) {
+	pool := sess.route.config.Pool
+	if sess.target != "" {
+		return p.blncer.BalanceAddr(sess.clientId, pool, sess.target)
+	}
+	if sess.targetPool != "" {
+		// client selected pool should be route pool if route restricted by pool
+		if pool != "" && pool != sess.targetPool {
+			return nil, balancer.ErrUpstreamNotAllowed
+		}
+		pool = sess.targetPool
+	}
+	return p.blncer.BalancePool(sess.clientId, pool)
+}
+
+// identify authenticates client connection and resolves session route by listener mode
+// handshake timeout covers PROXY protocol header and client handshake
+func (p *Proxy) identify(conn net.Conn, l *listener) (*session, error) {
+	if err := conn.SetDeadline(time.Now().Add(time.Duration(p.config.HandshakeTimeout) * time.Second)); err != nil {
+		return nil, err
+	}
+	// real client addr from trusted load balancer
+	srcAddr := conn.RemoteAddr()
+	if l.isTrusted(srcAddr) {
+		h, err := proxyproto.Read(conn)
+		if err != nil {
+			log.Printf("proxy: handler: listener %v: read proxy protocol header from %v: %v", l.config.Name, srcAddr, err)
+			return nil, handshakeErr(err)
+		}
+		// header without addrs (LOCAL command or unknown) keeps conn addr
+		if h.SrcAddr != nil {
+			srcAddr = h.SrcAddr
+		}
+	}
+
+	var (
+		sess *session
+		err  error
+	)
+	switch l.config.Mode {
+	case ListenerModePassthrough:
+		sess, err = p.identifyPassthrough(conn, l)
+	case ListenerModePlain:
+		sess, err = p.identifyPlain(conn, l, srcAddr)
+	case ListenerModeConnect:
+		sess, err = p.identifyConnect(conn, l)
+	case ListenerModeSOCKS5, ListenerModeSOCKS5Plain:
+		sess, err = p.identifySOCKS5(conn, l)
+	default:
+		sess, err = p.identifyMTLS(conn, l)
+		if err == nil && l.config.Preamble {
+			err = readPreamble(sess)
+		}
+	}
+	if err != nil {
+		return nil, handshakeErr(err)
+	}
+	if err := sess.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	sess.srcAddr, sess.dstAddr = srcAddr, conn.LocalAddr()
+	return sess, nil
+}
+
+// handshakeErr return ErrHandshakeTimeout if err is deadline exceeded
+func handshakeErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrHandshakeTimeout
+	}
+	return err
+}
+
+// mTLS: client id from client certificate, route by tls server name (SNI) and negotiated ALPN protocol
+func (p *Proxy) identifyMTLS(conn net.Conn, l *listener) (*session, error) {
+	tc := tls.Server(conn, l.tlsConf)
+	clnId, err := p.authzConn(tc)
+	if err != nil {
+		return nil, err
+	}
+	sess := &session{conn: tc, clientId: clnId}
+	cs := tc.ConnectionState()
+	sess.serverName, sess.proto = cs.ServerName, cs.NegotiatedProtocol
+	sess.tlsVersion = cs.Version
+	if len(cs.PeerCertificates) > 0 {
+		sess.clientCert = cs.PeerCertificates[0]
+	}
+	sess.route = l.route(sess.serverName, sess.proto)
+	return sess, nil
+}
+
+// passthrough: tls not terminated, route by server name (SNI) peeked from client hello
+// client certificate not visible so client id set by route config
+func (p *Proxy) identifyPassthrough(conn net.Conn, l *listener) (*session, error) {
+	hello, prefix, err := peekClientHello(conn)
+	if err != nil {
+		log.Printf("proxy: handler: peek client hello: %v", err)
+		return nil, err
+	}
+	sess := &session{
+		conn:        conn,
+		serverName:  hello.ServerName,
+		passthrough: true,
+		prefix:      prefix,
+	}
+	// ALPN protocol negotiated by upstream, route matched only by server name
+	sess.route = l.route(sess.serverName, "")
+	sess.clientId = sess.route.config.ClientId
+	return sess, nil
+}
+
+// plain: no tls, client id resolved by source addr, listener client id used for unknown sources
+func (p *Proxy) identifyPlain(conn net.Conn, l *listener, srcAddr net.Addr) (*session, error) {
+	clnId, err := p.resolveSource(l, srcAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &session{conn: conn, route: l.defaultRoute, clientId: clnId}, nil
+}
+
+// resolveSource return client id of source addr (auth client source cidrs), listener client id if not matched
+func (p *Proxy) resolveSource(l *listener, srcAddr net.Addr) (string, error) {
+	var ip net.IP
+	switch a := srcAddr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		if id, ok := p.auth.ResolveAddr(addr); ok {
+			return id, nil
+		}
+	}
+	if l.config.ClientId == "" {
+		return "", fmt.Errorf("source addr %v not authn", srcAddr)
+	}
+	return l.config.ClientId, nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/radisvaliullin/proxy/pkg/auth"
+)
+
+// PROXY protocol header read only from trusted sources
+func TestListenerIsTrusted(t *testing.T) {
+	enabled := ListenerProxyProtocolConfig{Enabled: true}
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name string
+		conf ListenerProxyProtocolConfig
+		addr net.Addr
+		want bool
+	}{
+		{name: "disabled", addr: &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}},
+		{name: "trusted", conf: enabled, addr: &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}, want: true},
+		{name: "untrusted", conf: enabled, addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1")}},
+		{name: "ipv4-mapped", conf: enabled, addr: &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.1.1")}, want: true},
+		{name: "unix", conf: enabled, addr: &net.UnixAddr{Name: "@", Net: "unix"}, want: true},
+	}
+	for _, tt := range tests {
+		l := &listener{config: ListenerConfig{ProxyProtocol: tt.conf}, trustedNets: trusted}
+		if got := l.isTrusted(tt.addr); got != tt.want {
+			t.Errorf("%v: trusted %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// PROXY protocol header accepted only from trusted sources
+func TestIdentifyProxyProtocolTrusted(t *testing.T) {
+	au, err := auth.New(auth.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{config: Config{HandshakeTimeout: 5}, auth: au}
+	const header = "PROXY TCP4 10.1.1.1 10.0.0.2 1234 443\r\n"
+
+	tests := []struct {
+		name    string
+		trusted string
+		// client addr of session and stream data after identify
+		wantSrc string
+		want    string
+	}{
+		{name: "trusted", trusted: "127.0.0.0/8", wantSrc: "10.1.1.1:1234", want: "data"},
+		// untrusted source header is client data, client addr not spoofed
+		{name: "untrusted", trusted: "10.0.0.0/8", want: header + "data"},
+	}
+	for _, tt := range tests {
+		l := &listener{
+			config: ListenerConfig{
+				Mode:          ListenerModePlain,
+				ClientId:      "c",
+				ProxyProtocol: ListenerProxyProtocolConfig{Enabled: true},
+			},
+			trustedNets:  []netip.Prefix{netip.MustParsePrefix(tt.trusted)},
+			defaultRoute: &route{},
+		}
+		client, server := tcpPair(t)
+		if _, err := io.WriteString(client, header+"data"); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+
+		sess, err := p.identify(server, l)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		wantSrc := tt.wantSrc
+		if wantSrc == "" {
+			wantSrc = client.LocalAddr().String()
+		}
+		if sess.srcAddr.String() != wantSrc {
+			t.Fatalf("%v: client addr %v, want %v", tt.name, sess.srcAddr, wantSrc)
+		}
+		if got, _ := io.ReadAll(sess.conn); string(got) != tt.want {
+			t.Fatalf("%v: stream %q, want %q", tt.name, got, tt.want)
+		}
+		if _, ok := sess.srcAddr.(*net.TCPAddr); !ok {
+			t.Fatalf("%v: client addr %T, want tcp addr", tt.name, sess.srcAddr)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+// SOCKS5 (RFC 1928) and username/password auth (RFC 1929)
+const (
+	socks5Version       = 0x05
+	socks5AuthVersion   = 0x01
+	socks5MethodNoAuth  = 0x00
+	socks5MethodPass    = 0x02
+	socks5MethodNone    = 0xFF
+	socks5CmdConnect    = 0x01
+	socks5AtypIPv4      = 0x01
+	socks5AtypDomain    = 0x03
+	socks5AtypIPv6      = 0x04
+	socks5AuthSucceeded = 0x00
+	socks5AuthFailed    = 0x01
+)
+
+// SOCKS5 reply codes
+const (
+	socks5RepSucceeded        = 0x00
+	socks5RepFailure          = 0x01
+	socks5RepNotAllowed       = 0x02
+	socks5RepHostUnreachable  = 0x04
+	socks5RepConnRefused      = 0x05
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAtypNotSupported = 0x08
+)
+
+// socks5: client names destination, upstream addr (should match configured upstream addr) or pool name (domain)
+// over mTLS client identified by client certificate (no auth method)
+// plaintext client identified by username (client id) and password (auth client password hash)
+func (p *Proxy) identifySOCKS5(conn net.Conn, l *listener) (*session, error) {
+	var sess *session
+	if l.config.Mode == ListenerModeSOCKS5 {
+		s, err := p.identifyMTLS(conn, l)
+		if err != nil {
+			return nil, err
+		}
+		sess = s
+	} else {
+		sess = &session{conn: conn, route: l.defaultRoute}
+	}
+
+	// method selection
+	method := byte(socks5MethodNoAuth)
+	if sess.clientId == "" {
+		method = socks5MethodPass
+	}
+	methods, err := readSOCKS5Greeting(sess.conn)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = sess.conn.Write([]byte{socks5Version, socks5MethodNone})
+		return nil, errors.New("socks5: no acceptable auth method")
+	}
+	if _, err := sess.conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5MethodPass {
+		clnId, err := p.socks5AuthPassword(sess.conn)
+		if err != nil {
+			return nil, err
+		}
+		sess.clientId = clnId
+	}
+
+	// connect request
+	target, err := readSOCKS5Request(sess.conn)
+	if err != nil {
+		return nil, err
+	}
+	// domain equal to pool name selects pool (port ignored)
+	if host, _, err := net.SplitHostPort(target); err == nil && p.blncer.HasPool(host) {
+		sess.targetPool = host
+	} else {
+		sess.target = target
+	}
+	sess.reply = func(err error) error {
+		return writeSOCKS5Reply(sess.conn, socks5Rep(err))
+	}
+	return sess, nil
+}
+
+// readSOCKS5Greeting return client auth methods
+func readSOCKS5Greeting(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("socks5: wrong version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// socks5AuthPassword authenticates client by username (client id) and password
+func (p *Proxy) socks5AuthPassword(rw io.ReadWriter) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(rw, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5AuthVersion {
+		return "", fmt.Errorf("socks5: wrong auth version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(rw, hdr[:1]); err != nil {
+		return "", err
+	}
+	pass := make([]byte, hdr[0])
+	if _, err := io.ReadFull(rw, pass); err != nil {
+		return "", err
+	}
+	if !p.auth.AuthNPassword(string(user), string(pass)) {
+		_, _ = rw.Write([]byte{socks5AuthVersion, socks5AuthFailed})
+		return "", fmt.Errorf("socks5: client %q password not authn", user)
+	}
+	if _, err := rw.Write([]byte{socks5AuthVersion, socks5AuthSucceeded}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// readSOCKS5Request return destination (host:port) of connect request
+func readSOCKS5Request(rw io.ReadWriter) (string, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(rw, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("socks5: wrong version %d", hdr[0])
+	}
+	if hdr[1] != socks5CmdConnect {
+		_ = writeSOCKS5Reply(rw, socks5RepCmdNotSupported)
+		return "", fmt.Errorf("socks5: command %d not supported", hdr[1])
+	}
+	var host string
+	switch hdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(rw, hdr[:1]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, hdr[0])
+		if _, err := io.ReadFull(rw, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKS5Reply(rw, socks5RepAtypNotSupported)
+		return "", fmt.Errorf("socks5: address type %d not supported", hdr[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(rw, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Rep return reply code of upstream connect result
+func socks5Rep(err error) byte {
+	switch {
+	case err == nil:
+		return socks5RepSucceeded
+	case errors.Is(err, balancer.ErrUpstreamNotAllowed),
+		errors.Is(err, balancer.ErrClientNotConfig),
+		errors.Is(err, ErrClientNotAllowed):
+		return socks5RepNotAllowed
+	case errors.Is(err, balancer.ErrCanNotGetUpstream):
+		return socks5RepHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnRefused
+	default:
+		return socks5RepFailure
+	}
+}
+
+// writeSOCKS5Reply writes reply with zero bind addr (ipv4 0.0.0.0:0)
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
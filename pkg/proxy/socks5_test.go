@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/radisvaliullin/proxy/pkg/auth"
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+// newSOCKS5TestProxy return proxy of client c (password "pass") and pool p of upstream u1
+func newSOCKS5TestProxy(t *testing.T) *Proxy {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	au, err := auth.New(auth.Config{Clients: []auth.Client{{Id: "c", PasswordHash: string(hash)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blncer, err := balancer.New(balancer.Config{
+		UpstrmAddrs: []string{"u1:80"},
+		Pools:       []balancer.Pool{{Name: "p", UpstreamAddrs: []string{"u1:80"}}},
+	}, au)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Proxy{auth: au, blncer: blncer}
+}
+
+func TestIdentifySOCKS5Plain(t *testing.T) {
+	p := newSOCKS5TestProxy(t)
+	l := &listener{config: ListenerConfig{Mode: ListenerModeSOCKS5Plain}, defaultRoute: &route{}}
+
+	greeting := string([]byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodPass})
+	authOk := string([]byte{socks5AuthVersion, 1, 'c', 4, 'p', 'a', 's', 's'})
+	// replies of method selection and auth
+	accepted := string([]byte{socks5Version, socks5MethodPass, socks5AuthVersion, socks5AuthSucceeded})
+	request := func(atyp byte, addr ...byte) string {
+		return string(append([]byte{socks5Version, socks5CmdConnect, 0, atyp}, append(addr, 0, 80)...))
+	}
+	reply := func(rep byte) string {
+		return string([]byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+
+	tests := []struct {
+		name       string
+		sent       string
+		target     string
+		targetPool string
+		reply      string
+		ok         bool
+	}{
+		{name: "ipv4", sent: greeting + authOk + request(socks5AtypIPv4, 10, 0, 0, 1), target: "10.0.0.1:80", reply: accepted, ok: true},
+		{
+			name: "ipv6", sent: greeting + authOk + request(socks5AtypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1),
+			target: "[::1]:80", reply: accepted, ok: true,
+		},
+		{name: "domain upstream", sent: greeting + authOk + request(socks5AtypDomain, 2, 'u', '1'), target: "u1:80", reply: accepted, ok: true},
+		// domain equal to pool name selects pool
+		{name: "domain pool", sent: greeting + authOk + request(socks5AtypDomain, 1, 'p'), targetPool: "p", reply: accepted, ok: true},
+		{name: "wrong version", sent: string([]byte{4, 1, socks5MethodPass})},
+		{name: "truncated greeting", sent: string([]byte{socks5Version, 2, socks5MethodPass})},
+		// plain listener requires password auth
+		{
+			name: "no acceptable method", sent: string([]byte{socks5Version, 1, socks5MethodNoAuth}),
+			reply: string([]byte{socks5Version, socks5MethodNone}),
+		},
+		{
+			name: "wrong password", sent: greeting + string([]byte{socks5AuthVersion, 1, 'c', 4, 'p', 'a', 's', 'x'}),
+			reply: string([]byte{socks5Version, socks5MethodPass, socks5AuthVersion, socks5AuthFailed}),
+		},
+		{
+			name: "unknown client", sent: greeting + string([]byte{socks5AuthVersion, 1, 'x', 4, 'p', 'a', 's', 's'}),
+			reply: string([]byte{socks5Version, socks5MethodPass, socks5AuthVersion, socks5AuthFailed}),
+		},
+		{name: "wrong auth version", sent: greeting + string([]byte{0x02, 1, 'c'}), reply: string([]byte{socks5Version, socks5MethodPass})},
+		{name: "truncated auth", sent: greeting + string([]byte{socks5AuthVersion, 1, 'c', 4, 'p'}), reply: string([]byte{socks5Version, socks5MethodPass})},
+		{
+			name: "bind command", sent: greeting + authOk + string([]byte{socks5Version, 0x02, 0, socks5AtypIPv4, 10, 0, 0, 1, 0, 80}),
+			reply: accepted + reply(socks5RepCmdNotSupported),
+		},
+		{
+			name: "wrong address type", sent: greeting + authOk + string([]byte{socks5Version, socks5CmdConnect, 0, 0x05}),
+			reply: accepted + reply(socks5RepAtypNotSupported),
+		},
+		{name: "truncated request", sent: greeting + authOk + request(socks5AtypIPv4, 10, 0, 0, 1)[:8], reply: accepted},
+	}
+	for _, tt := range tests {
+		conn := newBufConn(tt.sent)
+		sess, err := p.identifySOCKS5(conn, l)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%v: error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if conn.w.String() != tt.reply {
+			t.Fatalf("%v: reply %x, want %x", tt.name, conn.w.String(), tt.reply)
+		}
+		if err != nil {
+			continue
+		}
+		if sess.clientId != "c" || sess.target != tt.target || sess.targetPool != tt.targetPool {
+			t.Fatalf("%v: client %q target %q pool %q, want c %q %q", tt.name, sess.clientId, sess.target, sess.targetPool, tt.target, tt.targetPool)
+		}
+	}
+}
+
+func TestSOCKS5Rep(t *testing.T) {
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{err: nil, want: socks5RepSucceeded},
+		{err: balancer.ErrUpstreamNotAllowed, want: socks5RepNotAllowed},
+		{err: balancer.ErrClientNotConfig, want: socks5RepNotAllowed},
+		{err: ErrClientNotAllowed, want: socks5RepNotAllowed},
+		{err: balancer.ErrCanNotGetUpstream, want: socks5RepHostUnreachable},
+		{err: syscall.ECONNREFUSED, want: socks5RepConnRefused},
+		{err: errors.New("dial timeout"), want: socks5RepFailure},
+	}
+	for _, tt := range tests {
+		if got := socks5Rep(tt.err); got != tt.want {
+			t.Errorf("socks5Rep(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+)
+
+// max udp datagram size
+const udpMaxDatagram = 64 * 1024
+
+// max queued client datagrams of flow during flow setup (excess dropped)
+const udpFlowQueueLen = 16
+
+// udpFlow udp pseudo-session of client source addr
+// flow has own connected upstream socket, so upstream replies are matched by socket
+type udpFlow struct {
+	key      string
+	srcAddr  net.Addr
+	clientId string
+
+	// set by flow setup (upstream balanced and dialed)
+	upstr     balancer.Upstream
+	upstrConn net.Conn
+
+	// protects upstrConn, queue and failed during flow setup
+	mu sync.Mutex
+	// client datagrams received during flow setup
+	queue [][]byte
+	// flow setup failed
+	failed bool
+
+	// idle tracker shared by both directions
+	tracker *idleTracker
+	// flow max duration expiration (zero - no limit)
+	expireAt time.Time
+	// flow force closed by balancer (upstream drain timeout)
+	forceClosed atomic.Bool
+}
+
+// write forwards client datagram to upstream
+// datagrams of flow in setup queued (dropped if queue full or setup failed)
+func (f *udpFlow) write(b []byte) {
+	f.mu.Lock()
+	conn := f.upstrConn
+	if conn == nil {
+		if !f.failed && len(f.queue) < udpFlowQueueLen {
+			f.queue = append(f.queue, append([]byte(nil), b...))
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+		metricUDPDropped.Add(1)
+		return
+	}
+	f.mu.Unlock()
+	f.writeConn(conn, b)
+}
+
+func (f *udpFlow) writeConn(conn net.Conn, b []byte) {
+	f.tracker.touch(time.Now())
+	if _, err := conn.Write(b); err != nil {
+		log.Printf("proxy: udp: flow %v: write to upstream: %v", f.key, err)
+		metricUDPDropped.Add(1)
+	}
+}
+
+// ready forwards queued datagrams and sets dialed upstream conn
+// (queue written without lock, datagrams queued meanwhile written in next round)
+func (f *udpFlow) ready(conn net.Conn) {
+	for {
+		f.mu.Lock()
+		queue := f.queue
+		f.queue = nil
+		if len(queue) == 0 {
+			f.upstrConn = conn
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+		for _, b := range queue {
+			f.writeConn(conn, b)
+		}
+	}
+}
+
+// fail drops queued datagrams of failed flow setup
+func (f *udpFlow) fail() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = true
+	metricUDPDropped.Add(int64(len(f.queue)))
+	f.queue = nil
+}
+
+// udpFlows flows of udp listener by source addr
+type udpFlows struct {
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func (f *udpFlows) get(key string) *udpFlow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flows[key]
+}
+
+func (f *udpFlows) add(flow *udpFlow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flows[flow.key] = flow
+	metricUDPFlows.Add(1)
+}
+
+func (f *udpFlows) remove(flow *udpFlow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flows[flow.key] == flow {
+		delete(f.flows, flow.key)
+		metricUDPFlows.Add(-1)
+	}
+}
+
+// serveUDP reads client datagrams and forwards them to flow upstreams until listener closed
+// each flow (client source addr) is balanced and limited as a session
+// flow admitted and identified by read loop, upstream balanced and dialed by flow goroutine
+// (datagrams queued until upstream dialed), so slow upstream does not block other flows
+// read errors retried with accept backoff
+func (p *Proxy) serveUDP(l *listener) error {
+	flows := &udpFlows{flows: make(map[string]*udpFlow)}
+	buf := make([]byte, udpMaxDatagram)
+	// how long to sleep on read failure
+	var tempDelay time.Duration
+	for {
+		n, srcAddr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("proxy: udp: listener %v closed: %v", l.config.Name, err)
+				return err
+			}
+			metricAcceptErrors.Add(acceptErrTemporary, 1)
+			tempDelay = retryDelay(tempDelay)
+			log.Printf("proxy: udp: listener %v: read: %v; retrying in %v", l.config.Name, err, tempDelay)
+			time.Sleep(tempDelay)
+			continue
+		}
+		tempDelay = 0
+
+		key := srcAddr.String()
+		flow := flows.get(key)
+		if flow == nil {
+			if flow, err = p.newUDPFlow(l, key, srcAddr); err != nil {
+				log.Printf("proxy: udp: listener %v: flow %v: %v", l.config.Name, key, err)
+				metricUDPDropped.Add(1)
+				continue
+			}
+			flows.add(flow)
+			go p.runUDPFlow(l, flows, flow)
+		}
+		flow.write(buf[:n])
+	}
+}
+
+// newUDPFlow admits and authenticates flow of client source addr (non-blocking)
+func (p *Proxy) newUDPFlow(l *listener, key string, srcAddr net.Addr) (*udpFlow, error) {
+	if !l.admission.admit() {
+		return nil, errors.New("flow shed")
+	}
+	// no handshake
+	l.admission.handshakeDone()
+	clnId, err := p.resolveSource(l, srcAddr)
+	if err != nil {
+		l.admission.release()
+		return nil, err
+	}
+	if !l.defaultRoute.isAllowed(clnId) {
+		l.admission.release()
+		return nil, fmt.Errorf("client %v not allowed", clnId)
+	}
+	idleTimeout, maxDuration := p.sessionTimeouts(clnId)
+	flow := &udpFlow{
+		key:      key,
+		srcAddr:  srcAddr,
+		clientId: clnId,
+		tracker:  newIdleTracker(idleTimeout),
+	}
+	if maxDuration > 0 {
+		flow.expireAt = time.Now().Add(maxDuration)
+	}
+	return flow, nil
+}
+
+// runUDPFlow balances and dials flow upstream, then forwards upstream datagrams
+func (p *Proxy) runUDPFlow(l *listener, flows *udpFlows, flow *udpFlow) {
+	upstrConn, err := p.dialUDPFlow(l, flow)
+	if err != nil {
+		log.Printf("proxy: udp: listener %v: flow %v: %v", l.config.Name, flow.key, err)
+		flows.remove(flow)
+		flow.fail()
+		l.admission.release()
+		return
+	}
+	log.Printf("proxy: udp: listener %v: flow %v client %v upstream %v", l.config.Name, flow.key, flow.clientId, flow.upstr.Addr())
+	flow.ready(upstrConn)
+	p.forwardUDPFlow(l, flows, flow)
+}
+
+// dialUDPFlow balances flow upstream and dials upstream socket
+// upstream released on error
+func (p *Proxy) dialUDPFlow(l *listener, flow *udpFlow) (net.Conn, error) {
+	upstr, err := p.blncer.BalancePool(flow.clientId, l.defaultRoute.config.Pool)
+	if err != nil {
+		return nil, err
+	}
+	upstrConn, err := p.upstreamDialer(upstr).dialUDP(upstr.Addr())
+	upstr.Dialed(err)
+	if err != nil {
+		// dial error reported by Dialed
+		upstr.Close(nil)
+		return nil, err
+	}
+	flow.upstr = upstr
+	return upstrConn, nil
+}
+
+// forwardUDPFlow forwards upstream datagrams to client until flow idle, expired or failed
+func (p *Proxy) forwardUDPFlow(l *listener, flows *udpFlows, flow *udpFlow) {
+	// session error reported to balancer on upstream release
+	var sessErr error
+	defer func() {
+		flows.remove(flow)
+		if !flow.forceClosed.Load() {
+			connCloseWithLog(flow.upstrConn)
+		}
+		flow.upstr.Close(sessErr)
+		l.admission.release()
+	}()
+
+	// balancer force close releases blocked read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-flow.upstr.Done():
+			flow.forceClosed.Store(true)
+			connCloseWithLog(flow.upstrConn)
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		deadline := flow.tracker.deadline()
+		if !flow.expireAt.IsZero() && flow.expireAt.Before(deadline) {
+			deadline = flow.expireAt
+		}
+		if err := flow.upstrConn.SetReadDeadline(deadline); err != nil {
+			log.Printf("proxy: udp: flow %v: %v", flow.key, err)
+			return
+		}
+		n, err := flow.upstrConn.Read(buf)
+		if err != nil {
+			if flow.forceClosed.Load() {
+				log.Printf("proxy: udp: flow %v: %v", flow.key, ErrSessionForceClosed)
+				return
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("proxy: udp: flow %v: read from upstream: %v", flow.key, err)
+				sessErr = err
+				return
+			}
+			now := time.Now()
+			if !flow.expireAt.IsZero() && !now.Before(flow.expireAt) {
+				log.Printf("proxy: udp: flow %v: %v", flow.key, ErrSessionMaxDuration)
+				return
+			}
+			if !now.Before(flow.tracker.deadline()) {
+				log.Printf("proxy: udp: flow %v: idle, expired", flow.key)
+				return
+			}
+			continue
+		}
+		flow.tracker.touch(time.Now())
+		if _, err := l.pc.WriteTo(buf[:n], flow.srcAddr); err != nil {
+			log.Printf("proxy: udp: flow %v: write to client: %v", flow.key, err)
+			metricUDPDropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/radisvaliullin/proxy/pkg/balancer"
+	"github.com/radisvaliullin/proxy/pkg/proxyproto"
+)
+
+// UpstreamConfig upstream dial settings
+// settings matched by upstream addr, then by upstream pool, otherwise plain tcp dial used
+type UpstreamConfig struct {
+	// upstream addr (exact match, should be listed in upstream addrs)
+	Addr string `yaml:"addr"`
+	// upstream pool (settings applied to all upstreams of pool)
+	Pool string `yaml:"pool"`
+
+	// tls origination to upstream (re-encrypt)
+	TLS UpstreamTLSConfig `yaml:"tls"`
+	// PROXY protocol header sent to upstream, v1 or v2 (empty - not sent)
+	// v2 header has TLVs with client id, tls version and client cert sha256 fingerprint
+	ProxyProtocol string `yaml:"proxyProtocol"`
+
+	// in milliseconds, dial timeout (includes host resolve and tls handshake)
+	// default value 15000
+	DialTimeout int `yaml:"dialTimeout"`
+	// local ip used to dial upstream (optional)
+	// resolved upstream addrs of other ip family not dialed
+	SourceAddr string `yaml:"sourceAddr"`
+	// in seconds, cache ttl of upstream host resolved addrs
+	// default value 30
+	DNSTTL int `yaml:"dnsTTL"`
+}
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// upstream dial defaults
+const (
+	defaultDialTimeout = 15000
+	defaultDNSTTL      = 30
+)
+
+// UpstreamTLSConfig tls origination to upstream
+type UpstreamTLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// upstream CA Cert file path (empty - system roots)
+	CACertPath string `yaml:"caCertPath"`
+	// upstream server name to verify (default host of upstream addr)
+	ServerName string `yaml:"serverName"`
+	// proxy client Cert and Key file path for upstream mTLS (optional)
+	CertPath string `yaml:"certPath"`
+	KeyPath  string `yaml:"keyPath"`
+}
+
+func (c *UpstreamConfig) validate() error {
+	if (c.Addr == "") == (c.Pool == "") {
+		return fmt.Errorf("proxy: config: upstream settings should have addr or pool, addr %q pool %q", c.Addr, c.Pool)
+	}
+	if (c.TLS.CertPath == "") != (c.TLS.KeyPath == "") {
+		return fmt.Errorf("proxy: config: upstream %q%q tls cert and key should be set together", c.Addr, c.Pool)
+	}
+	switch c.ProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("proxy: config: upstream %q%q wrong proxy protocol %q", c.Addr, c.Pool, c.ProxyProtocol)
+	}
+	if c.DialTimeout < 0 || c.DNSTTL < 0 {
+		return fmt.Errorf("proxy: config: upstream %q%q wrong dial timeout or dns ttl", c.Addr, c.Pool)
+	}
+	c.setDefaults()
+	if c.SourceAddr != "" {
+		if _, err := netip.ParseAddr(c.SourceAddr); err != nil {
+			return fmt.Errorf("proxy: config: upstream %q%q wrong source addr %q: %w", c.Addr, c.Pool, c.SourceAddr, err)
+		}
+	}
+	return nil
+}
+
+func (c *UpstreamConfig) setDefaults() {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	if c.DNSTTL == 0 {
+		c.DNSTTL = defaultDNSTTL
+	}
+}
+
+// upstream dialer runtime state
+type upstreamDialer struct {
+	config UpstreamConfig
+
+	// resolver shared by dialers
+	resolver *resolver
+	// local source ip (invalid if not set)
+	sourceAddr netip.Addr
+	// nil if tls origination disabled
+	tlsConf *tls.Config
+}
+
+// newUpstreamDialer return dialer of upstream settings (config should be validated)
+func newUpstreamDialer(conf UpstreamConfig, res *resolver) (*upstreamDialer, error) {
+	d := &upstreamDialer{config: conf, resolver: res}
+	if conf.SourceAddr != "" {
+		// validated by config
+		d.sourceAddr, _ = netip.ParseAddr(conf.SourceAddr)
+		d.sourceAddr = d.sourceAddr.Unmap()
+	}
+	if !conf.TLS.Enabled {
+		return d, nil
+	}
+	d.tlsConf = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: conf.TLS.ServerName,
+	}
+	if conf.TLS.CACertPath != "" {
+		caCertBytes, err := os.ReadFile(conf.TLS.CACertPath)
+		if err != nil {
+			log.Printf("proxy: upstream %v%v: read CA cert file: %v", conf.Addr, conf.Pool, err)
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCertBytes) {
+			return nil, fmt.Errorf("proxy: upstream %v%v: CA cert not found", conf.Addr, conf.Pool)
+		}
+		d.tlsConf.RootCAs = caCertPool
+	}
+	if conf.TLS.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLS.CertPath, conf.TLS.KeyPath)
+		if err != nil {
+			log.Printf("proxy: upstream %v%v: client cert load: %v", conf.Addr, conf.Pool, err)
+			return nil, err
+		}
+		d.tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return d, nil
+}
+
+// dialInfo session info used to dial upstream
+type dialInfo struct {
+	// ALPN protocol advertised to upstream if tls origination enabled (empty - not advertised)
+	proto string
+	// passthrough session, client tls forwarded as is so tls origination not used
+	passthrough bool
+
+	// PROXY protocol header info
+	// client conn source and destination (listener) addrs
+	srcAddr    net.Addr
+	dstAddr    net.Addr
+	clientId   string
+	serverName string
+	// tls version and client cert sha256 fingerprint (tls terminated by proxy)
+	tlsVersion      uint16
+	certFingerprint []byte
+}
+
+// proxyHeader return PROXY protocol header of dial info
+func (di dialInfo) proxyHeader(version string) *proxyproto.Header {
+	h := &proxyproto.Header{
+		Version: proxyproto.Version1,
+		SrcAddr: di.srcAddr,
+		DstAddr: di.dstAddr,
+	}
+	if version != ProxyProtocolV2 {
+		return h
+	}
+	h.Version = proxyproto.Version2
+	if di.serverName != "" {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(di.serverName)})
+	}
+	if di.tlsVersion != 0 {
+		flags := byte(proxyproto.SSLClientSSL)
+		if di.certFingerprint != nil {
+			flags |= proxyproto.SSLClientCertConn
+		}
+		// client cert verified by proxy (mTLS), common name is client id
+		h.TLVs = append(h.TLVs, proxyproto.SSLTLV(flags, di.certFingerprint != nil, tls.VersionName(di.tlsVersion), di.clientId))
+	}
+	if di.clientId != "" {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TypeClientId, Value: []byte(di.clientId)})
+	}
+	if di.certFingerprint != nil {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TypeCertFingerprint, Value: di.certFingerprint})
+	}
+	return h
+}
+
+// dial dials upstream addr (ip:port, host:port or unix:///path)
+func (d *upstreamDialer) dial(addr string, di dialInfo) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.config.DialTimeout)*time.Millisecond)
+	defer cancel()
+	conn, err := d.dialConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// PROXY protocol header precedes upstream tls
+	if d.config.ProxyProtocol != "" {
+		if dl, ok := ctx.Deadline(); ok {
+			_ = conn.SetWriteDeadline(dl)
+		}
+		if _, err := di.proxyHeader(d.config.ProxyProtocol).WriteTo(conn); err != nil {
+			connCloseWithLog(conn)
+			return nil, err
+		}
+		_ = conn.SetWriteDeadline(time.Time{})
+	}
+	if d.tlsConf == nil || di.passthrough {
+		return conn, nil
+	}
+
+	tlsConf := d.tlsConf.Clone()
+	if tlsConf.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || host == "" {
+			connCloseWithLog(conn)
+			return nil, errors.New("proxy: upstream tls: server name not set")
+		}
+		tlsConf.ServerName = host
+	}
+	if di.proto != "" {
+		tlsConf.NextProtos = []string{di.proto}
+	}
+	tc := tls.Client(conn, tlsConf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		connCloseWithLog(conn)
+		return nil, err
+	}
+	// tls client handshake succeeds if upstream ignores ALPN, client protocol should be agreed by upstream
+	if negotiated := tc.ConnectionState().NegotiatedProtocol; di.proto != "" && negotiated != di.proto {
+		connCloseWithLog(tc)
+		return nil, fmt.Errorf("proxy: upstream tls: alpn protocol %q not negotiated, upstream protocol %q", di.proto, negotiated)
+	}
+	return tc, nil
+}
+
+// dialConn dials upstream conn, host name resolved (cached) and its addrs raced (Happy Eyeballs)
+func (d *upstreamDialer) dialConn(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	network, address := splitNetworkAddr(addr, "tcp")
+	if network == "unix" {
+		return dialer.DialContext(ctx, network, address)
+	}
+	if d.sourceAddr.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.sourceAddr.AsSlice()}
+	}
+	addrs, port, err := d.resolveAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if addrs == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	return dialHappyEyeballs(ctx, dialer.DialContext, interleaveFamilies(addrs), port)
+}
+
+// dialUDP dials upstream socket of udp flow (tls origination and PROXY protocol not used)
+// host name resolved (cached), first addr dialed (udp dial does not check upstream reachability)
+// unix addr is datagram socket, dialed from own bound local socket
+func (d *upstreamDialer) dialUDP(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.config.DialTimeout)*time.Millisecond)
+	defer cancel()
+	network, address := splitNetworkAddr(addr, "udp")
+	if network == "unix" {
+		return dialUnixgram(address)
+	}
+	dialer := &net.Dialer{}
+	if d.sourceAddr.IsValid() {
+		dialer.LocalAddr = &net.UDPAddr{IP: d.sourceAddr.AsSlice()}
+	}
+	addrs, port, err := d.resolveAddr(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if addrs != nil {
+		address = netip.AddrPortFrom(addrs[0], port).String()
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// resolveAddr return resolved (cached) addrs and port of host name address (host:port)
+// nil addrs if host is ip literal or empty (local system), such address dialed as is
+// source addr binds dial to own ip family, so addrs of other family skipped
+func (d *upstreamDialer) resolveAddr(ctx context.Context, address string) ([]netip.Addr, uint16, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil || host == "" {
+		return nil, 0, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("proxy: upstream %v: wrong port: %w", address, err)
+	}
+	addrs, err := d.resolver.resolve(ctx, host, time.Duration(d.config.DNSTTL)*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.sourceAddr.IsValid() {
+		filtered := make([]netip.Addr, 0, len(addrs))
+		for _, a := range addrs {
+			if a.Is4() == d.sourceAddr.Is4() {
+				filtered = append(filtered, a)
+			}
+		}
+		if len(filtered) == 0 {
+			return nil, 0, fmt.Errorf("proxy: upstream %v: no addrs of source addr %v family", address, d.sourceAddr)
+		}
+		addrs = filtered
+	}
+	return addrs, uint16(port), nil
+}
+
+// upstreamDialer return dialer of upstream, addr settings preferred, then pool settings
+// return default dialer if upstream has no settings
+func (p *Proxy) upstreamDialer(upstr balancer.Upstream) *upstreamDialer {
+	addr := upstr.Addr()
+	for _, d := range p.upstrDialers {
+		if d.config.Addr == addr {
+			return d
+		}
+	}
+	pools := upstr.Pools()
+	for _, d := range p.upstrDialers {
+		if d.config.Pool != "" && slices.Contains(pools, d.config.Pool) {
+			return d
+		}
+	}
+	return p.defaultDialer
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert return self-signed cert of 127.0.0.1 and its pem file path
+func testCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "upstream"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+// tlsUpstream starts tls upstream of ALPN protocols, handshakes accepted conns
+func tlsUpstream(t *testing.T, cert tls.Certificate, protos []string) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: protos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+				_, _ = conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstreamDialALPN(t *testing.T) {
+	cert, caPath := testCert(t)
+	conf := UpstreamConfig{Addr: "upstream", TLS: UpstreamTLSConfig{Enabled: true, CACertPath: caPath}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newUpstreamDialer(conf, newResolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		upstream []string
+		proto    string
+		ok       bool
+	}{
+		{name: "agreed", upstream: []string{"h2", "http/1.1"}, proto: "h2", ok: true},
+		{name: "not advertised", upstream: []string{"h2"}, proto: "", ok: true},
+		// upstream without ALPN ignores client protocols, handshake succeeds
+		{name: "ignored", upstream: nil, proto: "h2", ok: false},
+	}
+	for _, tt := range tests {
+		addr := tlsUpstream(t, cert, tt.upstream)
+		conn, err := d.dial(addr, dialInfo{proto: tt.proto})
+		if (err == nil) != tt.ok {
+			t.Fatalf("%v: dial error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil {
+			continue
+		}
+		if got := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; got != tt.proto {
+			t.Fatalf("%v: negotiated %q, want %q", tt.name, got, tt.proto)
+		}
+		conn.Close()
+	}
+}
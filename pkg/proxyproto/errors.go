@@ -0,0 +1,42 @@
+package proxyproto
+
+import "fmt"
+
+const (
+	ErrKindWrongVersion = iota
+	ErrKindTLVTooLong
+	ErrKindHeaderTooLong
+	ErrKindWrongHeader
+)
+
+var (
+	ErrWrongVersion  = ProxyProtoError{Kind: ErrKindWrongVersion}
+	ErrTLVTooLong    = ProxyProtoError{Kind: ErrKindTLVTooLong}
+	ErrHeaderTooLong = ProxyProtoError{Kind: ErrKindHeaderTooLong}
+	ErrWrongHeader   = ProxyProtoError{Kind: ErrKindWrongHeader}
+)
+
+func getErrorMessage(kind int) string {
+	switch kind {
+	case ErrKindWrongVersion:
+		return "wrong protocol version"
+	case ErrKindTLVTooLong:
+		return "tlv value too long"
+	case ErrKindHeaderTooLong:
+		return "header too long"
+	case ErrKindWrongHeader:
+		return "wrong header"
+	default:
+		return "unknown"
+	}
+}
+
+var _ error = ProxyProtoError{}
+
+type ProxyProtoError struct {
+	Kind int
+}
+
+func (e ProxyProtoError) Error() string {
+	return fmt.Sprintf("proxy protocol error: %s", getErrorMessage(e.Kind))
+}
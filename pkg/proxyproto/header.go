@@ -0,0 +1,202 @@
+// Package proxyproto implements PROXY protocol v1/v2 headers
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+// protocol versions
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// v2 TLV types
+const (
+	TypeALPN       = 0x01
+	TypeAuthority  = 0x02
+	TypeSSL        = 0x20
+	TypeSSLVersion = 0x21
+	TypeSSLCN      = 0x22
+	// custom types (0xE0-0xEF range reserved for application)
+	// client id authenticated by proxy
+	TypeClientId = 0xE0
+	// sha256 fingerprint of client certificate (DER)
+	TypeCertFingerprint = 0xE1
+)
+
+// v2 SSL TLV client flags
+const (
+	SSLClientSSL      = 0x01
+	SSLClientCertConn = 0x02
+	SSLClientCertSess = 0x04
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// v2 command and address families
+const (
+	v2VersionLocal = 0x20
+	v2VersionProxy = 0x21
+
+	v2FamUnspec = 0x00
+	v2FamTCP4   = 0x11
+	v2FamTCP6   = 0x21
+	v2FamUnix   = 0x31
+
+	v2UnixAddrLen = 108
+)
+
+// Header PROXY protocol header
+type Header struct {
+	Version int
+	// source (client) and destination (proxy listener) addrs
+	// nil or unsupported addrs sent as unknown (v1) or unspec (v2)
+	SrcAddr net.Addr
+	DstAddr net.Addr
+	// v2 only, ignored by v1
+	TLVs []TLV
+}
+
+// TLV v2 type-length-value
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// SSLTLV return v2 SSL TLV with version and common name sub-TLVs
+// verified - client cert verified by proxy
+func SSLTLV(flags byte, verified bool, version string, cn string) TLV {
+	verify := uint32(1)
+	if verified {
+		verify = 0
+	}
+	val := make([]byte, 5)
+	val[0] = flags
+	binary.BigEndian.PutUint32(val[1:], verify)
+	sub := []TLV{{Type: TypeSSLVersion, Value: []byte(version)}}
+	if cn != "" {
+		sub = append(sub, TLV{Type: TypeSSLCN, Value: []byte(cn)})
+	}
+	for _, t := range sub {
+		val = appendTLV(val, t)
+	}
+	return TLV{Type: TypeSSL, Value: val}
+}
+
+// Format return header bytes
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case Version1:
+		return h.formatV1(), nil
+	case Version2:
+		return h.formatV2()
+	default:
+		return nil, ErrWrongVersion
+	}
+}
+
+// WriteTo writes header to w
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *Header) formatV1() []byte {
+	src, srcOk := h.SrcAddr.(*net.TCPAddr)
+	dst, dstOk := h.DstAddr.(*net.TCPAddr)
+	if !srcOk || !dstOk || src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if srcIP, dstIP := src.IP.To4(), dst.IP.To4(); srcIP != nil && dstIP != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port))
+	}
+	// mixed families sent as TCP6, ipv4 addr as ipv4-mapped ipv6 addr
+	if src.IP.To16() == nil || dst.IP.To16() == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", v1IPv6(src.IP), v1IPv6(dst.IP), src.Port, dst.Port))
+}
+
+// v1IPv6 return ipv6 text of ip (net.IP formats ipv4-mapped addr as ipv4)
+func v1IPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	fam, addrs := v2Addrs(h.SrcAddr, h.DstAddr)
+	payload := addrs
+	for _, t := range h.TLVs {
+		if len(t.Value) > math.MaxUint16 {
+			return nil, ErrTLVTooLong
+		}
+		payload = appendTLV(payload, t)
+	}
+	if len(payload) > math.MaxUint16 {
+		return nil, ErrHeaderTooLong
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 16+len(payload)))
+	buf.Write(v2Signature)
+	buf.WriteByte(v2VersionProxy)
+	buf.WriteByte(fam)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// v2Addrs return v2 address family and address block
+func v2Addrs(srcAddr, dstAddr net.Addr) (byte, []byte) {
+	switch src := srcAddr.(type) {
+	case *net.TCPAddr:
+		dst, ok := dstAddr.(*net.TCPAddr)
+		if !ok || src == nil || dst == nil {
+			return v2FamUnspec, nil
+		}
+		if srcIP, dstIP := src.IP.To4(), dst.IP.To4(); srcIP != nil && dstIP != nil {
+			b := make([]byte, 0, 12)
+			b = append(b, srcIP...)
+			b = append(b, dstIP...)
+			b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+			return v2FamTCP4, binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+		}
+		srcIP, dstIP := src.IP.To16(), dst.IP.To16()
+		if srcIP == nil || dstIP == nil {
+			return v2FamUnspec, nil
+		}
+		b := make([]byte, 0, 36)
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+		return v2FamTCP6, binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+	case *net.UnixAddr:
+		dst, ok := dstAddr.(*net.UnixAddr)
+		if !ok || src == nil || dst == nil || len(src.Name) > v2UnixAddrLen || len(dst.Name) > v2UnixAddrLen {
+			return v2FamUnspec, nil
+		}
+		b := make([]byte, 2*v2UnixAddrLen)
+		copy(b, src.Name)
+		copy(b[v2UnixAddrLen:], dst.Name)
+		return v2FamUnix, b
+	default:
+		return v2FamUnspec, nil
+	}
+}
+
+func appendTLV(b []byte, t TLV) []byte {
+	b = append(b, t.Type)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.Value)))
+	return append(b, t.Value...)
+}
@@ -0,0 +1,119 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestFormatV1(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		want string
+	}{
+		{name: "tcp4", src: tcpAddr("10.0.0.1", 1234), dst: tcpAddr("10.0.0.2", 443), want: "PROXY TCP4 10.0.0.1 10.0.0.2 1234 443\r\n"},
+		{name: "tcp6", src: tcpAddr("2001:db8::1", 1234), dst: tcpAddr("::1", 443), want: "PROXY TCP6 2001:db8::1 ::1 1234 443\r\n"},
+		{name: "mixed", src: tcpAddr("10.0.0.1", 1234), dst: tcpAddr("::1", 443), want: "PROXY TCP6 ::ffff:10.0.0.1 ::1 1234 443\r\n"},
+		{name: "unknown nil", want: "PROXY UNKNOWN\r\n"},
+		{name: "unknown unix", src: &net.UnixAddr{Name: "/a"}, dst: &net.UnixAddr{Name: "/b"}, want: "PROXY UNKNOWN\r\n"},
+		{name: "unknown no ip", src: &net.TCPAddr{Port: 1}, dst: tcpAddr("::1", 443), want: "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		h := &Header{Version: Version1, SrcAddr: tt.src, DstAddr: tt.dst, TLVs: []TLV{{Type: TypeALPN, Value: []byte("h2")}}}
+		b, err := h.Format()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if string(b) != tt.want {
+			t.Fatalf("%v: header %q, want %q", tt.name, b, tt.want)
+		}
+	}
+}
+
+func TestFormatV2(t *testing.T) {
+	tlvs := []TLV{{Type: TypeClientId, Value: []byte("c")}, {Type: TypeALPN}}
+	tlvBytes := []byte{TypeClientId, 0, 1, 'c', TypeALPN, 0, 0}
+	unix := make([]byte, 2*v2UnixAddrLen)
+	copy(unix, "/src")
+	copy(unix[v2UnixAddrLen:], "/dst")
+
+	tests := []struct {
+		name  string
+		src   net.Addr
+		dst   net.Addr
+		fam   byte
+		addrs []byte
+	}{
+		{
+			name: "tcp4", src: tcpAddr("10.0.0.1", 1234), dst: tcpAddr("10.0.0.2", 443), fam: v2FamTCP4,
+			addrs: []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x04, 0xD2, 0x01, 0xBB},
+		},
+		{
+			name: "tcp6", src: tcpAddr("::1", 1234), dst: tcpAddr("::2", 443), fam: v2FamTCP6,
+			addrs: append(append(append(make([]byte, 15), 1), append(make([]byte, 15), 2)...), 0x04, 0xD2, 0x01, 0xBB),
+		},
+		{
+			name: "mixed", src: tcpAddr("10.0.0.1", 1234), dst: tcpAddr("::2", 443), fam: v2FamTCP6,
+			addrs: append(append(net.ParseIP("10.0.0.1").To16(), append(make([]byte, 15), 2)...), 0x04, 0xD2, 0x01, 0xBB),
+		},
+		{name: "unix", src: &net.UnixAddr{Name: "/src"}, dst: &net.UnixAddr{Name: "/dst"}, fam: v2FamUnix, addrs: unix},
+		{name: "unspec", fam: v2FamUnspec},
+		{name: "unspec mixed types", src: tcpAddr("10.0.0.1", 1), dst: &net.UnixAddr{Name: "/dst"}, fam: v2FamUnspec},
+	}
+	for _, tt := range tests {
+		h := &Header{Version: Version2, SrcAddr: tt.src, DstAddr: tt.dst, TLVs: tlvs}
+		b, err := h.Format()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		payloadLen := len(tt.addrs) + len(tlvBytes)
+		want := append(append([]byte{}, v2Signature...), v2VersionProxy, tt.fam, byte(payloadLen>>8), byte(payloadLen))
+		want = append(append(want, tt.addrs...), tlvBytes...)
+		if !bytes.Equal(b, want) {
+			t.Fatalf("%v: header %x, want %x", tt.name, b, want)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	long := make([]byte, math.MaxUint16+1)
+	half := make([]byte, math.MaxUint16/2)
+	tests := []struct {
+		name string
+		h    Header
+		want error
+	}{
+		{name: "version", h: Header{Version: 3}, want: ErrWrongVersion},
+		{name: "tlv too long", h: Header{Version: Version2, TLVs: []TLV{{Type: TypeALPN, Value: long}}}, want: ErrTLVTooLong},
+		{name: "header too long", h: Header{Version: Version2, TLVs: []TLV{{Value: half}, {Value: half}}}, want: ErrHeaderTooLong},
+	}
+	for _, tt := range tests {
+		if _, err := tt.h.Format(); !errors.Is(err, tt.want) {
+			t.Fatalf("%v: error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSSLTLV(t *testing.T) {
+	tlv := SSLTLV(SSLClientSSL|SSLClientCertConn, true, "TLSv1.3", "c")
+	want := []byte{SSLClientSSL | SSLClientCertConn, 0, 0, 0, 0,
+		TypeSSLVersion, 0, 7, 'T', 'L', 'S', 'v', '1', '.', '3',
+		TypeSSLCN, 0, 1, 'c'}
+	if tlv.Type != TypeSSL || !bytes.Equal(tlv.Value, want) {
+		t.Fatalf("tlv %x %x, want %x %x", tlv.Type, tlv.Value, TypeSSL, want)
+	}
+	// not verified, no common name
+	tlv = SSLTLV(SSLClientSSL, false, "TLSv1.2", "")
+	want = []byte{SSLClientSSL, 0, 0, 0, 1, TypeSSLVersion, 0, 7, 'T', 'L', 'S', 'v', '1', '.', '2'}
+	if !bytes.Equal(tlv.Value, want) {
+		t.Fatalf("tlv %x, want %x", tlv.Value, want)
+	}
+}
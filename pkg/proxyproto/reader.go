@@ -0,0 +1,153 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v1 header max length (with CRLF)
+const v1MaxLen = 107
+
+// Read reads PROXY protocol v1 or v2 header from r
+// reads exactly header bytes, so r can be used for following stream
+// header addrs nil if sender does not know them (v1 UNKNOWN, v2 LOCAL command or unspec family)
+func Read(r io.Reader) (*Header, error) {
+	// v1 min header ("PROXY UNKNOWN\r\n") longer than v2 signature
+	b := make([]byte, len(v2Signature), v1MaxLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readV1(r, b)
+	}
+	return nil, ErrWrongHeader
+}
+
+// readV1 reads rest of v1 header line
+func readV1(r io.Reader, b []byte) (*Header, error) {
+	one := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) == v1MaxLen {
+			return nil, ErrHeaderTooLong
+		}
+		if _, err := io.ReadFull(r, one); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		b = append(b, one[0])
+	}
+	fields := strings.Split(string(b[:len(b)-2]), " ")
+	h := &Header{Version: Version1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrWrongHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, ErrWrongHeader
+	}
+	// family by addr text, TCP6 addrs can be ipv4-mapped (::ffff:10.0.0.1)
+	isV6 := fields[1] == "TCP6"
+	if strings.Contains(fields[2], ":") != isV6 || strings.Contains(fields[3], ":") != isV6 {
+		return nil, ErrWrongHeader
+	}
+	h.SrcAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.DstAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, nil
+}
+
+// readV2 reads rest of v2 header after signature
+func readV2(r io.Reader) (*Header, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	verCmd, fam := b[0], b[1]
+	payload := make([]byte, binary.BigEndian.Uint16(b[2:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, ErrWrongVersion
+	}
+	h := &Header{Version: Version2}
+	var addrsLen int
+	switch fam {
+	case v2FamTCP4:
+		addrsLen = 12
+		if len(payload) >= addrsLen {
+			h.SrcAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}
+			h.DstAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:]))}
+		}
+	case v2FamTCP6:
+		addrsLen = 36
+		if len(payload) >= addrsLen {
+			h.SrcAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}
+			h.DstAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:]))}
+		}
+	case v2FamUnix:
+		addrsLen = 2 * v2UnixAddrLen
+		if len(payload) >= addrsLen {
+			h.SrcAddr = &net.UnixAddr{Name: unixName(payload[:v2UnixAddrLen]), Net: "unix"}
+			h.DstAddr = &net.UnixAddr{Name: unixName(payload[v2UnixAddrLen:addrsLen]), Net: "unix"}
+		}
+	default:
+		// unspec or not supported family, addrs skipped
+	}
+	if len(payload) < addrsLen {
+		return nil, ErrWrongHeader
+	}
+	tlvs, err := parseTLVs(payload[addrsLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	// LOCAL command (health checks of sender), addrs not used
+	if verCmd == v2VersionLocal {
+		h.SrcAddr, h.DstAddr = nil, nil
+	} else if verCmd != v2VersionProxy {
+		return nil, ErrWrongHeader
+	}
+	return h, nil
+}
+
+// unexpectedEOF return io.ErrUnexpectedEOF if stream ended inside header
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrWrongHeader
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, ErrWrongHeader
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+l]})
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
+
+func unixName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,131 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// header followed by stream data, Read reads exactly header bytes
+const streamData = "data"
+
+func TestReadFormatted(t *testing.T) {
+	tlvs := []TLV{
+		{Type: TypeClientId, Value: []byte("c")},
+		SSLTLV(SSLClientSSL|SSLClientCertConn, true, "TLSv1.3", "c"),
+		{Type: TypeALPN, Value: []byte{}},
+	}
+	tests := []struct {
+		name string
+		h    Header
+	}{
+		{name: "v1 tcp4", h: Header{Version: Version1, SrcAddr: tcpAddr("10.0.0.1", 1234), DstAddr: tcpAddr("10.0.0.2", 443)}},
+		{name: "v1 tcp6", h: Header{Version: Version1, SrcAddr: tcpAddr("2001:db8::1", 1234), DstAddr: tcpAddr("::1", 443)}},
+		{name: "v1 mixed", h: Header{Version: Version1, SrcAddr: tcpAddr("10.0.0.1", 1234), DstAddr: tcpAddr("::1", 443)}},
+		{name: "v1 unknown", h: Header{Version: Version1}},
+		{name: "v2 tcp4", h: Header{Version: Version2, SrcAddr: tcpAddr("10.0.0.1", 1234), DstAddr: tcpAddr("10.0.0.2", 443), TLVs: tlvs}},
+		{name: "v2 tcp6", h: Header{Version: Version2, SrcAddr: tcpAddr("2001:db8::1", 1234), DstAddr: tcpAddr("::1", 443), TLVs: tlvs}},
+		{name: "v2 mixed", h: Header{Version: Version2, SrcAddr: tcpAddr("10.0.0.1", 1234), DstAddr: tcpAddr("::1", 443), TLVs: tlvs}},
+		{
+			name: "v2 unix", h: Header{Version: Version2, SrcAddr: &net.UnixAddr{Name: "/src", Net: "unix"}, DstAddr: &net.UnixAddr{Name: "/dst", Net: "unix"}, TLVs: tlvs},
+		},
+		{name: "v2 unspec", h: Header{Version: Version2, TLVs: tlvs}},
+	}
+	for _, tt := range tests {
+		b, err := tt.h.Format()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		r := bytes.NewReader(append(b, streamData...))
+		got, err := Read(r)
+		if err != nil {
+			t.Fatalf("%v: read %q: %v", tt.name, b, err)
+		}
+		if got.Version != tt.h.Version {
+			t.Fatalf("%v: version %v, want %v", tt.name, got.Version, tt.h.Version)
+		}
+		if !sameAddr(got.SrcAddr, tt.h.SrcAddr) || !sameAddr(got.DstAddr, tt.h.DstAddr) {
+			t.Fatalf("%v: addrs %v %v, want %v %v", tt.name, got.SrcAddr, got.DstAddr, tt.h.SrcAddr, tt.h.DstAddr)
+		}
+		if !reflect.DeepEqual(got.TLVs, tt.h.TLVs) {
+			t.Fatalf("%v: tlvs %v, want %v", tt.name, got.TLVs, tt.h.TLVs)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != streamData {
+			t.Fatalf("%v: stream after header %q, want %q", tt.name, rest, streamData)
+		}
+	}
+}
+
+// sameAddr compares addrs by ip (ipv4 and ipv4-mapped equal), port and unix name
+func sameAddr(got, want net.Addr) bool {
+	switch w := want.(type) {
+	case nil:
+		return got == nil
+	case *net.TCPAddr:
+		g, ok := got.(*net.TCPAddr)
+		return ok && g.IP.Equal(w.IP) && g.Port == w.Port
+	case *net.UnixAddr:
+		g, ok := got.(*net.UnixAddr)
+		return ok && g.Name == w.Name
+	}
+	return false
+}
+
+func TestReadErrors(t *testing.T) {
+	v2 := func(verCmd, fam byte, length uint16, payload ...byte) []byte {
+		b := append([]byte{}, v2Signature...)
+		b = append(b, verCmd, fam, byte(length>>8), byte(length))
+		return append(b, payload...)
+	}
+	tcp4Addrs := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0, 1, 0, 2}
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   error
+	}{
+		{name: "empty", header: nil, want: io.EOF},
+		{name: "v1 truncated signature", header: []byte("PROXY"), want: io.ErrUnexpectedEOF},
+		{name: "v1 truncated line", header: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1 2"), want: io.ErrUnexpectedEOF},
+		{name: "v1 too long", header: []byte("PROXY TCP6 " + string(bytes.Repeat([]byte("f"), 120)) + "\r\n"), want: ErrHeaderTooLong},
+		{name: "v1 wrong protocol", header: []byte("PROXY UDP4 10.0.0.1 10.0.0.2 1 2\r\n"), want: ErrWrongHeader},
+		{name: "v1 wrong fields", header: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1\r\n"), want: ErrWrongHeader},
+		{name: "v1 wrong ip", header: []byte("PROXY TCP4 10.0.0.256 10.0.0.2 1 2\r\n"), want: ErrWrongHeader},
+		{name: "v1 wrong port", header: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 1 65536\r\n"), want: ErrWrongHeader},
+		{name: "v1 tcp4 with ipv6", header: []byte("PROXY TCP4 10.0.0.1 ::1 1 2\r\n"), want: ErrWrongHeader},
+		{name: "v1 tcp6 with ipv4", header: []byte("PROXY TCP6 10.0.0.1 ::1 1 2\r\n"), want: ErrWrongHeader},
+		{name: "wrong signature", header: []byte("GET / HTTP/1.1\r\n\r\n"), want: ErrWrongHeader},
+		{name: "v2 wrong signature", header: append([]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0B}, 0x21, 0x11, 0, 0), want: ErrWrongHeader},
+		{name: "v2 signature only", header: v2Signature, want: io.ErrUnexpectedEOF},
+		{name: "v2 truncated", header: v2(v2VersionProxy, v2FamTCP4, 12)[:14], want: io.ErrUnexpectedEOF},
+		{name: "v2 truncated payload", header: v2(v2VersionProxy, v2FamTCP4, 12, tcp4Addrs[:6]...), want: io.ErrUnexpectedEOF},
+		// length field beyond sent data, reader does not wait more than length
+		{name: "v2 oversized length", header: v2(v2VersionProxy, v2FamTCP4, 0xFFFF, tcp4Addrs...), want: io.ErrUnexpectedEOF},
+		{name: "v2 short addrs", header: v2(v2VersionProxy, v2FamTCP4, 6, tcp4Addrs[:6]...), want: ErrWrongHeader},
+		{name: "v2 wrong version", header: v2(0x11, v2FamTCP4, 12, tcp4Addrs...), want: ErrWrongVersion},
+		{name: "v2 wrong command", header: v2(0x22, v2FamTCP4, 12, tcp4Addrs...), want: ErrWrongHeader},
+		{name: "v2 truncated tlv", header: v2(v2VersionProxy, v2FamTCP4, 14, append(tcp4Addrs, TypeALPN, 0)...), want: ErrWrongHeader},
+		{name: "v2 tlv length beyond header", header: v2(v2VersionProxy, v2FamTCP4, 16, append(tcp4Addrs, TypeALPN, 0, 2, 'h')...), want: ErrWrongHeader},
+	}
+	for _, tt := range tests {
+		if _, err := Read(bytes.NewReader(tt.header)); !errors.Is(err, tt.want) {
+			t.Fatalf("%v: error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReadV2Local(t *testing.T) {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, v2VersionLocal, v2FamTCP4, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0, 1, 0, 2)
+	h, err := Read(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LOCAL command addrs not used
+	if h.Version != Version2 || h.SrcAddr != nil || h.DstAddr != nil {
+		t.Fatalf("header %+v, want v2 without addrs", h)
+	}
+}